@@ -0,0 +1,237 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// stopFlagIndex marks the final block sent to each
+// goroutine started by drain.
+const stopFlagIndex = 1
+
+// drain starts n goroutines that release every block
+// read from rw until each receives a stop block.
+func drain(b *testing.B, rw *ReadWriteCloser, n int) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				buf, err := rw.GetReadBuffer()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+
+				stop := buf.Flags[stopFlagIndex] != 0
+
+				if err := rw.SendReadBuffer(buf); err != nil {
+					b.Error(err)
+					return
+				}
+
+				if stop {
+					return
+				}
+			}
+		}()
+	}
+
+	return &wg
+}
+
+// stop sends a stop block for each of n goroutines
+// started by drain and waits for them to exit.
+func stop(b *testing.B, rw *ReadWriteCloser, n int, wg *sync.WaitGroup) {
+	for i := 0; i < n; i++ {
+		buf, err := rw.GetWriteBuffer()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		buf.Flags[stopFlagIndex] = 1
+
+		if _, err = rw.SendWriteBuffer(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	wg.Wait()
+}
+
+func createSimplex(b *testing.B, blockSize int) *ReadWriteCloser {
+	rw, err := CreateSimplex(testName(b), 0600, 1024, blockSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if err = rw.Unlink(); err != nil {
+		b.Fatal(err)
+	}
+
+	return rw
+}
+
+func BenchmarkGetSendWriteBuffer(b *testing.B) {
+	rw := createSimplex(b, 64)
+	defer rw.Close()
+
+	wg := drain(b, rw, 1)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf, err := rw.GetWriteBuffer()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = rw.SendWriteBuffer(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	stop(b, rw, 1, wg)
+}
+
+func BenchmarkReadWrite(b *testing.B) {
+	for _, size := range []int{64, 512, 4096, 65536} {
+		size := size
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkReadWrite(b, size)
+		})
+	}
+}
+
+func benchmarkReadWrite(b *testing.B, size int) {
+	rw := createSimplex(b, size)
+	defer rw.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		p := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			// Write marks every block with EOF.
+			if _, err := rw.Read(p); err != io.EOF {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	p := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := rw.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	<-done
+}
+
+func BenchmarkDuplexPingPong(b *testing.B) {
+	server, err := CreateDuplex(testName(b), 0600, 16, 64)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer server.Close()
+
+	client, err := OpenDuplex(server.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if err = server.Unlink(); err != nil {
+		b.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		p := make([]byte, 64)
+		for i := 0; i < b.N; i++ {
+			n, err := server.Read(p)
+			if err != io.EOF {
+				b.Error(err)
+				return
+			}
+
+			if _, err = server.Write(p[:n]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	p := make([]byte, 64)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(p); err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := client.Read(p); err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	<-done
+}
+
+func BenchmarkMPMC(b *testing.B) {
+	rw := createSimplex(b, 64)
+	defer rw.Close()
+
+	readers := runtime.GOMAXPROCS(0)
+	wg := drain(b, rw, readers)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf, err := rw.GetWriteBuffer()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			if _, err = rw.SendWriteBuffer(buf); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.StopTimer()
+
+	stop(b, rw, readers, wg)
+}
@@ -0,0 +1,631 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// SlowSubscriberPolicy decides what a Broadcaster does
+// when a subscriber has not released the block that is
+// about to be reused.
+type SlowSubscriberPolicy uint32
+
+const (
+	// BlockWriter makes the writer wait for the slowest
+	// subscriber. A subscriber whose process has exited
+	// without calling Close is detached by the writer,
+	// so the subscribers must share a PID namespace with
+	// the writer.
+	BlockWriter SlowSubscriberPolicy = iota
+	// DropSubscriber drops any subscriber that falls a
+	// full ring behind the writer. The dropped
+	// subscriber's next call returns ErrDropped.
+	DropSubscriber
+)
+
+const (
+	subscriberFree = iota
+	subscriberJoining
+	subscriberActive
+	subscriberDropped
+)
+
+const (
+	defaultMaxSubscribers = 64
+	maxSubscribers        = 1 << 16
+
+	// livenessInterval is how often a writer blocked on
+	// a slow subscriber checks that it is still alive.
+	livenessInterval = 100 * time.Millisecond
+)
+
+// BroadcastOptions holds the optional parameters
+// accepted by CreateBroadcast.
+type BroadcastOptions struct {
+	// Metadata and Timestamps are as for CreateOptions.
+	Metadata   []byte
+	Timestamps bool
+
+	// MaxSubscribers is the number of subscribers that
+	// may be attached at once. It defaults to 64.
+	MaxSubscribers int
+
+	// Policy decides how slow subscribers are handled.
+	// It defaults to BlockWriter.
+	Policy SlowSubscriberPolicy
+}
+
+// Broadcaster is the writer of a broadcast ring. Every
+// block it sends is read by each attached Subscriber,
+// and is only reused once every subscriber has released
+// it.
+//
+// A broadcast ring has a single writer, the methods of
+// Broadcaster must not be called concurrently.
+type Broadcaster struct {
+	name string
+
+	seg    *segment
+	shared *sharedMem
+	bcast  *sharedBroadcast
+	subs   []sharedSubscriber
+
+	policy     SlowSubscriberPolicy
+	timestamps bool
+
+	// Must be accessed using atomic operations
+	Flags *[sharedFlagsSize]uint32
+
+	closed uint32
+}
+
+// Subscriber is a reader of a broadcast ring. Each
+// Subscriber has its own cursor and receives every
+// block sent after it was opened.
+//
+// Buffers must be released with SendReadBuffer in the
+// order they were returned by GetReadBuffer. The
+// methods of Subscriber must not be called
+// concurrently.
+type Subscriber struct {
+	name string
+
+	seg    *segment
+	shared *sharedMem
+	bcast  *sharedBroadcast
+	slot   *sharedSubscriber
+
+	// head is the sequence number of the next block to
+	// be returned by GetReadBuffer.
+	head uint64
+
+	// Must be accessed using atomic operations
+	Flags *[sharedFlagsSize]uint32
+
+	closed uint32
+}
+
+// broadcastHeader returns the broadcast header and the
+// subscriber table that follow shared. The header size
+// has been checked against the size of the mapping, but
+// not that it leaves room for the broadcast header, nor
+// that it holds no more than maxSubscribers.
+func broadcastHeader(shared *sharedMem) (*sharedBroadcast, []sharedSubscriber, error) {
+	headerSize := uint64(shared.HeaderSize)
+	if headerSize < sharedHeaderSize+broadcastHeaderSize+subscriberSize {
+		return nil, nil, ErrInvalidSharedMemory
+	}
+
+	count := (headerSize - sharedHeaderSize - broadcastHeaderSize) / subscriberSize
+	if count > maxSubscribers {
+		return nil, nil, ErrInvalidSharedMemory
+	}
+
+	bcast := (*sharedBroadcast)(unsafe.Pointer(uintptr(unsafe.Pointer(shared)) + sharedHeaderSize))
+	subs := (*[maxSubscribers]sharedSubscriber)(unsafe.Pointer(uintptr(unsafe.Pointer(bcast)) + broadcastHeaderSize))
+	return bcast, subs[:count:count], nil
+}
+
+func blockAt(r *ring, seq uint64) *sharedBlock {
+	blocks := uintptr(unsafe.Pointer(r.shared)) + uintptr(r.headerSize)
+	index := seq % uint64(r.shared.BlockCount)
+	return (*sharedBlock)(unsafe.Pointer(blocks + uintptr(index*r.fullBlockSize)))
+}
+
+// CreateBroadcast creates a broadcast ring of blockCount
+// blocks of blockSize bytes. opts may be nil.
+func CreateBroadcast(name string, perm os.FileMode, blockCount, blockSize int, opts *BroadcastOptions) (*Broadcaster, error) {
+	var (
+		metadata []byte
+		features uint32
+	)
+
+	subscribers, policy := defaultMaxSubscribers, BlockWriter
+
+	if opts != nil {
+		metadata, policy = opts.Metadata, opts.Policy
+
+		if opts.Timestamps {
+			features |= featureTimestamps
+		}
+
+		if opts.MaxSubscribers > 0 {
+			subscribers = opts.MaxSubscribers
+		}
+	}
+
+	if subscribers > maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	headerSize := sharedHeaderSize + broadcastHeaderSize + uint64(subscribers)*subscriberSize
+	g := geometry{uint64(blockCount), uint64(blockSize)}
+
+	seg, err := createSegment(name, 0, perm, [2]geometry{g, g}, headerSize, nil, metadata, features, incompatBroadcast)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := seg.rings[0].shared
+	bcast, subs, err := broadcastHeader(shared)
+	if err != nil {
+		unix.Munmap(seg.data)
+		Unlink(name)
+		return nil, err
+	}
+
+	*(*uint32)(&bcast.Policy) = uint32(policy)
+
+	return &Broadcaster{
+		name: name,
+
+		seg:    seg,
+		shared: shared,
+		bcast:  bcast,
+		subs:   subs,
+
+		policy:     policy,
+		timestamps: features&featureTimestamps != 0,
+
+		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
+	}, nil
+}
+
+// OpenSubscriber attaches a new subscriber to the named
+// broadcast ring. It returns ErrTooManySubscribers if
+// every subscriber slot is in use.
+func OpenSubscriber(name string) (*Subscriber, error) {
+	seg, err := openSegment(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if seg.incompat&incompatBroadcast == 0 {
+		unix.Munmap(seg.data)
+		return nil, ErrNotBroadcast
+	}
+
+	shared := seg.rings[0].shared
+	bcast, subs, err := broadcastHeader(shared)
+	if err != nil {
+		unix.Munmap(seg.data)
+		return nil, err
+	}
+
+	var slot *sharedSubscriber
+
+	for i := range subs {
+		if atomic.CompareAndSwapUint32((*uint32)(&subs[i].State), subscriberFree, subscriberJoining) {
+			slot = &subs[i]
+			break
+		}
+	}
+
+	if slot == nil {
+		unix.Munmap(seg.data)
+		return nil, ErrTooManySubscribers
+	}
+
+	*(*uint32)(&slot.PID) = uint32(os.Getpid())
+
+	blockCount := uint64(shared.BlockCount)
+
+	var head uint64
+
+	for {
+		head = atomic.LoadUint64((*uint64)(&bcast.WriteSeq))
+
+		atomic.StoreUint64((*uint64)(&slot.Head), head)
+		atomic.StoreUint64((*uint64)(&slot.Tail), head)
+		atomic.StoreUint32((*uint32)(&slot.State), subscriberActive)
+
+		// The writer ignores joining subscribers, so it
+		// may have reused the block at head before it saw
+		// this one become active.
+		if atomic.LoadUint64((*uint64)(&bcast.WriteSeq))-head < blockCount {
+			break
+		}
+
+		atomic.StoreUint32((*uint32)(&slot.State), subscriberJoining)
+	}
+
+	return &Subscriber{
+		name: name,
+
+		seg:    seg,
+		shared: shared,
+		bcast:  bcast,
+		slot:   slot,
+
+		head: head,
+
+		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
+	}, nil
+}
+
+// Broadcaster
+
+func (b *Broadcaster) Close() error {
+	if !atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+		return nil
+	}
+
+	return unix.Munmap(b.seg.data)
+}
+
+// Name returns the name of the shared memory.
+func (b *Broadcaster) Name() string {
+	return b.name
+}
+
+// Metadata returns a copy of the application-defined
+// metadata that was passed in BroadcastOptions.
+//
+// It returns nil if no metadata was set.
+func (b *Broadcaster) Metadata() []byte {
+	if len(b.seg.metadata) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), b.seg.metadata...)
+}
+
+// Unlink removes the shared memory.
+//
+// It is the equivalent to calling Unlink(string) with
+// the same name as CreateBroadcast.
+func (b *Broadcaster) Unlink() error {
+	return Unlink(b.name)
+}
+
+// Subscribers returns the number of attached
+// subscribers that have not been dropped.
+func (b *Broadcaster) Subscribers() int {
+	var n int
+	for i := range b.subs {
+		if atomic.LoadUint32((*uint32)(&b.subs[i].State)) == subscriberActive {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (b *Broadcaster) Write(p []byte) (n int, err error) {
+	buf, err := b.GetWriteBuffer()
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(buf.Data[:cap(buf.Data)], p)
+	buf.Data = buf.Data[:n]
+
+	buf.Flags[eofFlagIndex] |= eofFlagMask
+
+	_, err = b.SendWriteBuffer(buf)
+	return n, err
+}
+
+func (b *Broadcaster) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		buf, err := b.GetWriteBuffer()
+		if err != nil {
+			return n, err
+		}
+
+		nn, err := r.Read(buf.Data[:cap(buf.Data)])
+		buf.Data = buf.Data[:nn]
+		n += int64(nn)
+
+		if err == io.EOF {
+			buf.Flags[eofFlagIndex] |= eofFlagMask
+		} else {
+			buf.Flags[eofFlagIndex] &^= eofFlagMask
+		}
+
+		if _, putErr := b.SendWriteBuffer(buf); putErr != nil {
+			return n, err
+		}
+
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (b *Broadcaster) GetWriteBuffer() (Buffer, error) {
+	if atomic.LoadUint32(&b.closed) != 0 {
+		return Buffer{}, io.ErrClosedPipe
+	}
+
+	r := &b.seg.rings[0]
+	blockCount := uint64(b.shared.BlockCount)
+	seq := atomic.LoadUint64((*uint64)(&b.bcast.WriteSeq))
+
+	for {
+		avail := (*event)(&b.bcast.Avail)
+		v := avail.Load()
+
+		var slow, dropped bool
+
+		for i := range b.subs {
+			sub := &b.subs[i]
+
+			if atomic.LoadUint32((*uint32)(&sub.State)) != subscriberActive {
+				continue
+			}
+
+			if seq-atomic.LoadUint64((*uint64)(&sub.Tail)) < blockCount {
+				continue
+			}
+
+			if b.policy == DropSubscriber {
+				if atomic.CompareAndSwapUint32((*uint32)(&sub.State), subscriberActive, subscriberDropped) {
+					dropped = true
+				}
+
+				continue
+			}
+
+			// A subscriber that exited without calling
+			// Close would otherwise block the writer
+			// forever, its slot is freed for reuse.
+			if !processAlive(atomic.LoadUint32((*uint32)(&sub.PID))) {
+				atomic.CompareAndSwapUint32((*uint32)(&sub.State), subscriberActive, subscriberFree)
+				continue
+			}
+
+			slow = true
+		}
+
+		if dropped {
+			// Wake the dropped subscribers so that they
+			// see they have been dropped.
+			if err := ((*event)(&b.bcast.Signal)).Broadcast(); err != nil {
+				return Buffer{}, err
+			}
+		}
+
+		if !slow {
+			break
+		}
+
+		atomic.AddUint64((*uint64)(&b.shared.WriteWaits), 1)
+
+		// The wait is bounded so that a slow subscriber
+		// that exits is noticed.
+		waitStart := time.Now()
+		err := avail.WaitTimeout(v, livenessInterval)
+		recordWait((*uint64)(&b.shared.WriteWaitNanos), (*[waitBuckets]uint64)(&b.shared.WriteWaitHist), time.Since(waitStart))
+
+		if err != nil {
+			return Buffer{}, err
+		}
+	}
+
+	block := blockAt(r, seq)
+	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+
+	return Buffer{
+		block: block,
+		index: uint32(seq % blockCount),
+		write: true,
+		seq:   seq,
+
+		Data:  data[:0:b.shared.BlockSize],
+		Flags: flags,
+	}, nil
+}
+
+func (b *Broadcaster) SendWriteBuffer(buf Buffer) (n int, err error) {
+	if atomic.LoadUint32(&b.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+
+	if !buf.write || buf.block == nil || buf.seq != atomic.LoadUint64((*uint64)(&b.bcast.WriteSeq)) {
+		return 0, ErrInvalidBuffer
+	}
+
+	block := buf.block
+
+	*(*uint64)(&block.Size) = uint64(len(buf.Data))
+
+	if b.timestamps {
+		*(*uint64)(&block.PublishedAt) = uint64(Monotonic())
+	}
+
+	atomic.AddUint64((*uint64)(&b.shared.BlocksSent), 1)
+	atomic.AddUint64((*uint64)(&b.shared.BytesSent), uint64(len(buf.Data)))
+
+	atomic.StoreUint64((*uint64)(&b.bcast.WriteSeq), buf.seq+1)
+
+	return len(buf.Data), ((*event)(&b.bcast.Signal)).Broadcast()
+}
+
+// Subscriber
+
+// Close detaches the subscriber, its unreleased blocks
+// are released.
+func (s *Subscriber) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	atomic.StoreUint32((*uint32)(&s.slot.State), subscriberFree)
+
+	err := ((*event)(&s.bcast.Avail)).Broadcast()
+
+	if merr := unix.Munmap(s.seg.data); err == nil {
+		err = merr
+	}
+
+	return err
+}
+
+// Name returns the name of the shared memory.
+func (s *Subscriber) Name() string {
+	return s.name
+}
+
+// Metadata returns a copy of the application-defined
+// metadata that was passed in BroadcastOptions.
+//
+// It returns nil if no metadata was set.
+func (s *Subscriber) Metadata() []byte {
+	if len(s.seg.metadata) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), s.seg.metadata...)
+}
+
+func (s *Subscriber) Read(p []byte) (n int, err error) {
+	buf, err := s.GetReadBuffer()
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(p, buf.Data)
+	isEOF := buf.Flags[eofFlagIndex]&eofFlagMask != 0
+
+	if err = s.SendReadBuffer(buf); err != nil {
+		return n, err
+	}
+
+	if isEOF {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (s *Subscriber) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		buf, err := s.GetReadBuffer()
+		if err != nil {
+			return n, err
+		}
+
+		nn, err := w.Write(buf.Data)
+		n += int64(nn)
+
+		isEOF := buf.Flags[eofFlagIndex]&eofFlagMask != 0
+
+		if putErr := s.SendReadBuffer(buf); putErr != nil {
+			return n, putErr
+		}
+
+		if err != nil || isEOF {
+			return n, err
+		}
+	}
+}
+
+func (s *Subscriber) GetReadBuffer() (Buffer, error) {
+	if atomic.LoadUint32(&s.closed) != 0 {
+		return Buffer{}, io.ErrClosedPipe
+	}
+
+	signal := (*event)(&s.bcast.Signal)
+
+	for {
+		if atomic.LoadUint32((*uint32)(&s.slot.State)) == subscriberDropped {
+			return Buffer{}, ErrDropped
+		}
+
+		v := signal.Load()
+
+		if s.head != atomic.LoadUint64((*uint64)(&s.bcast.WriteSeq)) {
+			break
+		}
+
+		atomic.AddUint64((*uint64)(&s.shared.ReadWaits), 1)
+
+		waitStart := time.Now()
+		err := signal.Wait(v)
+		recordWait((*uint64)(&s.shared.ReadWaitNanos), (*[waitBuckets]uint64)(&s.shared.ReadWaitHist), time.Since(waitStart))
+
+		if err != nil {
+			return Buffer{}, err
+		}
+	}
+
+	seq := s.head
+	s.head++
+	atomic.StoreUint64((*uint64)(&s.slot.Head), s.head)
+
+	block := blockAt(&s.seg.rings[0], seq)
+	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+
+	return Buffer{
+		block: block,
+		index: uint32(seq % uint64(s.shared.BlockCount)),
+		seq:   seq,
+
+		Data:  data[:block.Size:s.shared.BlockSize],
+		Flags: flags,
+
+		PublishedAt: int64(block.PublishedAt),
+	}, nil
+}
+
+// SendReadBuffer releases buf. It returns ErrDropped if
+// the subscriber was dropped while buf was held, in
+// which case the block may have been overwritten.
+func (s *Subscriber) SendReadBuffer(buf Buffer) error {
+	if atomic.LoadUint32(&s.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if buf.write || buf.block == nil || buf.seq != atomic.LoadUint64((*uint64)(&s.slot.Tail)) {
+		return ErrInvalidBuffer
+	}
+
+	atomic.AddUint64((*uint64)(&s.shared.BlocksReceived), 1)
+	atomic.AddUint64((*uint64)(&s.shared.BytesReceived), uint64(buf.block.Size))
+
+	atomic.StoreUint64((*uint64)(&s.slot.Tail), buf.seq+1)
+
+	if err := ((*event)(&s.bcast.Avail)).Broadcast(); err != nil {
+		return err
+	}
+
+	if atomic.LoadUint32((*uint32)(&s.slot.State)) == subscriberDropped {
+		return ErrDropped
+	}
+
+	return nil
+}
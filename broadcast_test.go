@@ -0,0 +1,221 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestBroadcast checks that every subscriber receives
+// every block sent after it was opened.
+func TestBroadcast(t *testing.T) {
+	name := testName(t)
+
+	b, err := CreateBroadcast(name, 0600, 4, 64, &BroadcastOptions{MaxSubscribers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.Unlink()
+
+	var subs []*Subscriber
+	for i := 0; i < 2; i++ {
+		s, err := OpenSubscriber(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		subs = append(subs, s)
+	}
+
+	if _, err := OpenSubscriber(name); err != ErrTooManySubscribers {
+		t.Fatalf("OpenSubscriber returned %v, expected %v", err, ErrTooManySubscribers)
+	}
+
+	if n := b.Subscribers(); n != 2 {
+		t.Errorf("Subscribers returned %d, expected 2", n)
+	}
+
+	// More blocks than the ring holds are sent, so the
+	// writer must wait for both subscribers to release
+	// each block.
+	const count = 16
+
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := b.Write([]byte(fmt.Sprint(i))); err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		errc <- nil
+	}()
+
+	p := make([]byte, 64)
+	for i := 0; i < count; i++ {
+		for j, s := range subs {
+			n, err := s.Read(p)
+			if err != io.EOF {
+				t.Fatalf("subscriber %d: Read returned %v, expected %v", j, err, io.EOF)
+			}
+
+			if string(p[:n]) != fmt.Sprint(i) {
+				t.Fatalf("subscriber %d: Read returned %q, expected %q", j, p[:n], fmt.Sprint(i))
+			}
+		}
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// A closed subscriber frees its slot.
+	subs[0].Close()
+
+	s, err := OpenSubscriber(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// TestBroadcastDropSubscriber checks that a subscriber
+// that falls a full ring behind is dropped rather than
+// block the writer.
+func TestBroadcastDropSubscriber(t *testing.T) {
+	name := testName(t)
+
+	b, err := CreateBroadcast(name, 0600, 4, 64, &BroadcastOptions{Policy: DropSubscriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.Unlink()
+
+	s, err := OpenSubscriber(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 8; i++ {
+		if _, err := b.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := b.Subscribers(); n != 0 {
+		t.Errorf("Subscribers returned %d, expected 0", n)
+	}
+
+	if _, err := s.GetReadBuffer(); err != ErrDropped {
+		t.Fatalf("GetReadBuffer returned %v, expected %v", err, ErrDropped)
+	}
+}
+
+// TestBroadcastDeadSubscriber checks that a subscriber
+// whose process exited without calling Close does not
+// block the writer forever.
+func TestBroadcastDeadSubscriber(t *testing.T) {
+	name := testName(t)
+
+	b, err := CreateBroadcast(name, 0600, 4, 64, &BroadcastOptions{MaxSubscribers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.Unlink()
+
+	cmd := startHelper(t, "subscribe", name)
+
+	if n := b.Subscribers(); n != 1 {
+		t.Fatalf("Subscribers returned %d, expected 1", n)
+	}
+
+	// The ring is filled while the subscriber lives.
+	for i := 0; i < 4; i++ {
+		if _, err := b.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.Write([]byte("x"))
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * livenessInterval):
+		t.Fatal("Write blocked on a subscriber that exited")
+	}
+
+	if n := b.Subscribers(); n != 0 {
+		t.Errorf("Subscribers returned %d, expected 0", n)
+	}
+
+	// The slot of the dead subscriber may be reused.
+	s, err := OpenSubscriber(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// TestBroadcastHeaderBounds checks that a subscriber
+// table that does not fit the header is rejected.
+func TestBroadcastHeaderBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		blockCount, blockSize int
+		headerSize            uint64
+		setBlockCount         uint32
+	}{
+		{"below broadcast header", 4, 64, sharedHeaderSize + 8, 4},
+		{"too many subscribers", 4, 1 << 21, sharedHeaderSize + broadcastHeaderSize + (maxSubscribers+1)*subscriberSize, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := testName(t)
+
+			b, err := CreateBroadcast(name, 0600, tc.blockCount, tc.blockSize, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			defer b.Unlink()
+
+			// The ring is shrunk to keep the layout within
+			// the file, so that only the subscriber table is
+			// at fault.
+			*(*uint32)(&b.shared.HeaderSize) = uint32(tc.headerSize)
+			*(*uint32)(&b.shared.BlockCount) = tc.setBlockCount
+
+			if s, err := OpenSubscriber(name); err != ErrInvalidSharedMemory {
+				if err == nil {
+					s.Close()
+				}
+
+				t.Fatalf("OpenSubscriber returned %v, expected %v", err, ErrInvalidSharedMemory)
+			}
+		})
+	}
+}
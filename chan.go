@@ -0,0 +1,177 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package shm
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Chan sends and receives values of type T through a
+// ReadWriteCloser, one value per block. Values are
+// copied directly into and out of Buffer.Data, without
+// any serialisation.
+//
+// T must have a fixed layout and hold no pointers, see
+// NewChan. As the value is copied byte for byte, every
+// attached process must agree on the layout of T,
+// including between 32-bit and 64-bit processes. The
+// size of int and uint differs between them, as does
+// the alignment of 64-bit fields, so T must use sized
+// integers and be explicitly padded, for instance with
+// blank fields, so that no field needs implicit
+// padding on any architecture.
+type Chan[T any] struct {
+	rw   *ReadWriteCloser
+	size int
+}
+
+// NewChan returns a Chan for values of type T.
+//
+// It returns ErrNotPlainType if T, or any type it is
+// composed of, is a pointer, slice, map, channel,
+// function, interface, string, int, uint or uintptr,
+// or is a struct that needs implicit padding on any
+// architecture. It returns
+// ErrTypeTooLarge if T does not fit in a block of
+// either ring.
+func NewChan[T any](rw *ReadWriteCloser) (*Chan[T], error) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if !plainType(typ) {
+		return nil, ErrNotPlainType
+	}
+
+	stats := rw.Stats()
+	if int(typ.Size()) > stats.Read.BlockSize || int(typ.Size()) > stats.Write.BlockSize {
+		return nil, ErrTypeTooLarge
+	}
+
+	return &Chan[T]{rw, int(typ.Size())}, nil
+}
+
+// plainType reports whether values of typ may be copied
+// between processes byte for byte.
+//
+// Structs must not need implicit padding under the
+// strictest alignment of any architecture, that of
+// plainAlign. 32-bit architectures align 64-bit fields
+// to only 4 bytes, so a struct that needs no padding
+// here could still need it on a 64-bit architecture.
+func plainType(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return plainType(typ.Elem())
+	case reflect.Struct:
+		var offset uintptr
+
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Offset != offset || offset%plainAlign(field.Type) != 0 || !plainType(field.Type) {
+				return false
+			}
+
+			offset += field.Type.Size()
+		}
+
+		return offset == typ.Size() && offset%plainAlign(typ) == 0
+	default:
+		return false
+	}
+}
+
+// plainAlign returns the alignment of typ on 64-bit
+// architectures, which is the size of its largest
+// component. typ must be composed of the kinds that
+// plainType accepts.
+func plainAlign(typ reflect.Type) uintptr {
+	switch typ.Kind() {
+	case reflect.Array:
+		return plainAlign(typ.Elem())
+	case reflect.Struct:
+		align := uintptr(1)
+
+		for i := 0; i < typ.NumField(); i++ {
+			if a := plainAlign(typ.Field(i).Type); a > align {
+				align = a
+			}
+		}
+
+		return align
+	case reflect.Complex64, reflect.Complex128:
+		return typ.Size() / 2
+	default:
+		return typ.Size()
+	}
+}
+
+// ReadWriteCloser returns the underlying
+// ReadWriteCloser.
+func (c *Chan[T]) ReadWriteCloser() *ReadWriteCloser {
+	return c.rw
+}
+
+// Send copies v into the next block and sends it. It
+// waits for a block to become free, as GetWriteBuffer.
+func (c *Chan[T]) Send(v T) error {
+	buf, err := c.rw.GetWriteBuffer()
+	if err != nil {
+		return err
+	}
+
+	if cap(buf.Data) < c.size {
+		// The shared memory has since been resized.
+		c.rw.AbortWriteBuffer(buf)
+		return ErrTypeTooLarge
+	}
+
+	buf.Data = buf.Data[:c.size]
+	copy(buf.Data, (*[1 << 30]byte)(unsafe.Pointer(&v))[:c.size:c.size])
+
+	_, err = c.rw.SendWriteBuffer(buf)
+	return err
+}
+
+// Recv receives the next value. It waits for a block
+// to be sent, as GetReadBuffer.
+//
+// It returns ErrInvalidBuffer, and releases the block,
+// if the block does not hold exactly one T.
+func (c *Chan[T]) Recv() (T, error) {
+	var v T
+
+	buf, err := c.rw.GetReadBuffer()
+	if err != nil {
+		return v, err
+	}
+
+	ok := len(buf.Data) == c.size
+	if ok {
+		copy((*[1 << 30]byte)(unsafe.Pointer(&v))[:c.size:c.size], buf.Data)
+	}
+
+	if err = c.rw.SendReadBuffer(buf); err != nil {
+		return v, err
+	}
+
+	if !ok {
+		return v, ErrInvalidBuffer
+	}
+
+	return v, nil
+}
+
+// Close closes the underlying ReadWriteCloser.
+func (c *Chan[T]) Close() error {
+	return c.rw.Close()
+}
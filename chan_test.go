@@ -0,0 +1,126 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package shm
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestPlainType checks that only types with the same
+// layout on 32-bit and 64-bit architectures are
+// accepted.
+func TestPlainType(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		v     interface{}
+		plain bool
+	}{
+		{"uint64", uint64(0), true},
+		{"complex64", complex64(0), true},
+		{"array", [3]uint16{}, true},
+		{"padded", struct {
+			A int32
+			_ int32
+			B int64
+		}{}, true},
+		{"trailing padded", struct {
+			A int64
+			B int32
+			_ int32
+		}{}, true},
+		{"array of structs", [2]struct {
+			A int32
+			B int16
+			_ int16
+		}{}, true},
+		{"complex64 after int32", struct {
+			A int32
+			B complex64
+		}{}, true},
+
+		{"int", int(0), false},
+		{"string", "", false},
+		{"pointer", new(int32), false},
+		{"slice", []byte(nil), false},
+		// 4-byte aligned on 386, 8 on amd64.
+		{"int64 after int32", struct {
+			A int32
+			B int64
+		}{}, false},
+		{"trailing int32", struct {
+			A int64
+			B int32
+		}{}, false},
+		{"nested trailing int32", struct {
+			A struct {
+				A int64
+				B int32
+			}
+			B int32
+		}{}, false},
+		{"float64 in array after int32", struct {
+			A int32
+			B [1]float64
+		}{}, false},
+		{"uint16 after uint8", struct {
+			A uint8
+			B uint16
+		}{}, false},
+	} {
+		if plain := plainType(reflect.TypeOf(tc.v)); plain != tc.plain {
+			t.Errorf("%s: plainType returned %t, expected %t", tc.name, plain, tc.plain)
+		}
+	}
+}
+
+// TestChan checks that values sent on a Chan are
+// received intact, and that NewChan rejects types that
+// are not plain or do not fit in a block.
+func TestChan(t *testing.T) {
+	type value struct {
+		A int32
+		_ int32
+		B float64
+		C [4]uint8
+		_ [4]uint8
+	}
+
+	rw := createRing(t, 4, 64)
+
+	c, err := NewChan[value](rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := value{A: -1, B: 1.5, C: [4]uint8{1, 2, 3, 4}}
+	if err := c.Send(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("Recv returned %+v, expected %+v", got, want)
+	}
+
+	if _, err := NewChan[struct {
+		A int32
+		B int64
+	}](rw); err != ErrNotPlainType {
+		t.Errorf("NewChan returned %v, expected %v", err, ErrNotPlainType)
+	}
+
+	if _, err := NewChan[[65]byte](rw); err != ErrTypeTooLarge {
+		t.Errorf("NewChan returned %v, expected %v", err, ErrTypeTooLarge)
+	}
+}
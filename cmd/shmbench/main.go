@@ -0,0 +1,221 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Command shmbench measures the latency of
+// github.com/tmthrgd/shm-go between processes.
+//
+// Usage:
+//
+// 	shmbench latency [-blocks n] [-size n] [-count n]
+// 	shmbench pingpong [-blocks n] [-size n] [-count n]
+//
+// latency and pingpong run the writer or echo side in
+// a child process. latency measures one-way latency
+// from the block's publish timestamp, pingpong
+// measures round trips over duplex shared memory.
+// Both report throughput and the p50, p99 and p99.9
+// latencies.
+//
+// In-process benchmarks are run with go test -bench.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+func must(name string, err error) {
+	if err != nil {
+		panic(fmt.Sprintf("%s failed with err: %v\n", name, err))
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %[1]s latency [-blocks n] [-size n] [-count n]
+       %[1]s pingpong [-blocks n] [-size n] [-count n]
+`, os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	blocks := fs.Int("blocks", 1024, "number of blocks in each ring")
+	size := fs.Int("size", 64, "size of each block, a multiple of 64")
+	count := fs.Int("count", 1000000, "number of messages to send")
+	fs.Parse(os.Args[2:])
+
+	switch os.Args[1] {
+	case "latency":
+		latency(*blocks, *size, *count)
+	case "pingpong":
+		pingpong(*blocks, *size, *count)
+	case "child":
+		// child NAME MODE COUNT is run by latency and
+		// pingpong, it is not intended to be run directly.
+		n, err := strconv.Atoi(fs.Arg(2))
+		must("strconv.Atoi", err)
+
+		child(fs.Arg(0), fs.Arg(1), n)
+	default:
+		usage()
+	}
+}
+
+func name() string {
+	return fmt.Sprintf("/shmbench-%d", os.Getpid())
+}
+
+// latency and pingpong
+
+func spawn(name, mode string, count int) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "child", name, mode, strconv.Itoa(count))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	must("cmd.Start", cmd.Start())
+	return cmd
+}
+
+func child(name, mode string, count int) {
+	switch mode {
+	case "latency":
+		rw, err := shm.OpenSimplex(name)
+		must("OpenSimplex", err)
+
+		for i := 0; i < count; i++ {
+			buf, err := rw.GetWriteBuffer()
+			must("GetWriteBuffer", err)
+
+			buf.Data = buf.Data[:cap(buf.Data)]
+
+			_, err = rw.SendWriteBuffer(buf)
+			must("SendWriteBuffer", err)
+		}
+
+		must("Close", rw.Close())
+	case "pingpong":
+		rw, err := shm.OpenDuplex(name)
+		must("OpenDuplex", err)
+
+		for i := 0; i < count; i++ {
+			rbuf, err := rw.GetReadBuffer()
+			must("GetReadBuffer", err)
+
+			wbuf, err := rw.GetWriteBuffer()
+			must("GetWriteBuffer", err)
+
+			wbuf.Data = wbuf.Data[:copy(wbuf.Data[:cap(wbuf.Data)], rbuf.Data)]
+
+			must("SendReadBuffer", rw.SendReadBuffer(rbuf))
+
+			_, err = rw.SendWriteBuffer(wbuf)
+			must("SendWriteBuffer", err)
+		}
+
+		must("Close", rw.Close())
+	default:
+		usage()
+	}
+}
+
+func latency(blocks, size, count int) {
+	rw, err := shm.CreateSimplexWithOptions(name(), 0600, blocks, size, &shm.CreateOptions{
+		Timestamps: true,
+	})
+	must("CreateSimplexWithOptions", err)
+
+	defer rw.Unlink()
+	defer rw.Close()
+
+	cmd := spawn(rw.Name(), "latency", count)
+
+	samples := make([]time.Duration, count)
+
+	var start time.Time
+
+	for i := range samples {
+		buf, err := rw.GetReadBuffer()
+		must("GetReadBuffer", err)
+
+		samples[i] = time.Duration(shm.Monotonic() - buf.PublishedAt)
+
+		if i == 0 {
+			start = time.Now()
+		}
+
+		must("SendReadBuffer", rw.SendReadBuffer(buf))
+	}
+
+	elapsed := time.Since(start)
+
+	must("cmd.Wait", cmd.Wait())
+
+	report("one-way", samples, elapsed, size)
+}
+
+func pingpong(blocks, size, count int) {
+	rw, err := shm.CreateDuplex(name(), 0600, blocks, size)
+	must("CreateDuplex", err)
+
+	defer rw.Unlink()
+	defer rw.Close()
+
+	cmd := spawn(rw.Name(), "pingpong", count)
+
+	samples := make([]time.Duration, count)
+
+	start := time.Now()
+
+	for i := range samples {
+		sent := time.Now()
+
+		buf, err := rw.GetWriteBuffer()
+		must("GetWriteBuffer", err)
+
+		buf.Data = buf.Data[:cap(buf.Data)]
+
+		_, err = rw.SendWriteBuffer(buf)
+		must("SendWriteBuffer", err)
+
+		buf, err = rw.GetReadBuffer()
+		must("GetReadBuffer", err)
+
+		must("SendReadBuffer", rw.SendReadBuffer(buf))
+
+		samples[i] = time.Since(sent)
+	}
+
+	elapsed := time.Since(start)
+
+	must("cmd.Wait", cmd.Wait())
+
+	report("round trip", samples, elapsed, size)
+}
+
+func report(kind string, samples []time.Duration, elapsed time.Duration, size int) {
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+
+	percentile := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+
+	perSec := float64(len(samples)) / elapsed.Seconds()
+
+	fmt.Printf("messages:   %d of %d bytes in %s\n", len(samples), size, elapsed)
+	fmt.Printf("throughput: %.0f msg/s, %.2f MB/s\n", perSec, perSec*float64(size)/1e6)
+	fmt.Printf("%s latency: p50 %s, p99 %s, p99.9 %s, max %s\n", kind,
+		percentile(0.50), percentile(0.99), percentile(0.999), samples[len(samples)-1])
+}
@@ -0,0 +1,336 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Command shmctl lists, inspects and cleans up shared
+// memory created by github.com/tmthrgd/shm-go.
+//
+// Usage:
+//
+// 	shmctl ls
+// 	shmctl inspect NAME
+// 	shmctl unlink NAME
+// 	shmctl gc [-n]
+//
+// gc removes shared memory whose creating process no
+// longer exists. The generations of resizable shared
+// memory, NAME.1, NAME.2 and so on, are removed along
+// with NAME once neither it nor any of them has a live
+// creator. Process IDs are only meaningful within a
+// single PID namespace, so gc should not be run from a
+// different container to the creator.
+//
+// Broadcast and mailbox shared memory cannot be
+// observed, so they are reported but never listed,
+// inspected or removed by gc.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// shmDir is where Linux exposes POSIX shared memory.
+const shmDir = "/dev/shm"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %[1]s ls
+       %[1]s inspect NAME
+       %[1]s unlink NAME
+       %[1]s gc [-n]
+`, os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	var err error
+
+	switch args := flag.Args()[1:]; flag.Arg(0) {
+	case "ls":
+		err = ls()
+	case "inspect":
+		if len(args) != 1 {
+			usage()
+		}
+
+		err = inspect(normalise(args[0]))
+	case "unlink":
+		if len(args) != 1 {
+			usage()
+		}
+
+		err = shm.Unlink(normalise(args[0]))
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		dryRun := fs.Bool("n", false, "print what would be removed without removing it")
+		fs.Parse(args)
+
+		err = gc(*dryRun)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+// normalise adds the leading slash that shm_open(3)
+// expects, so that names may be given as listed by ls.
+func normalise(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+
+	return "/" + name
+}
+
+// observe calls fn for every shared memory segment in
+// shmDir that has a valid shm-go header.
+func observe(fn func(o *shm.Observer) error) error {
+	files, err := ioutil.ReadDir(shmDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		o, err := shm.OpenObserver("/" + file.Name())
+		switch err.(type) {
+		case nil:
+		case *shm.VersionError:
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", os.Args[0], file.Name(), err)
+			continue
+		default:
+			if os.IsPermission(err) || err == shm.ErrBroadcast || err == shm.ErrMailbox {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", os.Args[0], file.Name(), err)
+			}
+
+			continue
+		}
+
+		err = fn(o)
+		o.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func kind(h shm.Header) string {
+	if h.Duplex {
+		return "duplex"
+	}
+
+	return "simplex"
+}
+
+func ls() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tVERSION\tBLOCKS\tBLOCK SIZE\tCREATOR")
+
+	err := observe(func(o *shm.Observer) error {
+		h := o.Header()
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", o.Name(), kind(h), h.Version,
+			h.Read.BlockCount, h.Read.BlockSize, h.CreatorPID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func inspect(name string) error {
+	o, err := shm.OpenObserver(name)
+	if err != nil {
+		return err
+	}
+
+	defer o.Close()
+
+	h, stats := o.Header(), o.Stats()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", o.Name())
+	fmt.Fprintf(w, "type:\t%s\n", kind(h))
+	fmt.Fprintf(w, "version:\t%s\n", h.Version)
+	fmt.Fprintf(w, "features:\t%#x\n", h.Features)
+	fmt.Fprintf(w, "incompatible features:\t%#x\n", h.IncompatFeatures)
+	fmt.Fprintf(w, "generation:\t%d\n", h.Generation)
+	fmt.Fprintf(w, "creator:\t%d (%s)\n", h.CreatorPID, liveness(h.CreatorPID))
+	fmt.Fprintf(w, "flags:\t%#x\n", h.Flags)
+
+	if md := o.Metadata(); md != nil {
+		fmt.Fprintf(w, "metadata:\t%q\n", md)
+	}
+
+	rings := []struct {
+		name   string
+		header shm.RingHeader
+		stats  shm.RingStats
+	}{
+		{"read", h.Read, stats.Read},
+		{"write", h.Write, stats.Write},
+	}
+
+	if !h.Duplex {
+		rings = rings[:1]
+		rings[0].name = "ring"
+	}
+
+	for _, r := range rings {
+		fmt.Fprintf(w, "\n%s:\n", r.name)
+		fmt.Fprintf(w, "  geometry:\t%d blocks of %d bytes\n", r.header.BlockCount, r.header.BlockSize)
+		fmt.Fprintf(w, "  read cursors:\tstart %d, end %d\n", r.header.ReadStart, r.header.ReadEnd)
+		fmt.Fprintf(w, "  write cursors:\tstart %d, end %d\n", r.header.WriteStart, r.header.WriteEnd)
+		fmt.Fprintf(w, "  occupancy:\t%d readable, %d writable, %d in flight\n",
+			r.stats.Readable, r.stats.Writable, r.stats.InFlight)
+		fmt.Fprintf(w, "  sent:\t%d blocks, %d bytes\n", r.stats.BlocksSent, r.stats.BytesSent)
+		fmt.Fprintf(w, "  received:\t%d blocks, %d bytes\n", r.stats.BlocksReceived, r.stats.BytesReceived)
+		fmt.Fprintf(w, "  overwritten:\t%d blocks\n", r.stats.Overwritten)
+		fmt.Fprintf(w, "  aborted:\t%d blocks\n", r.stats.Aborted)
+		fmt.Fprintf(w, "  waits:\t%d read (%s), %d write (%s)\n",
+			r.stats.ReadWaits, r.stats.ReadWaitTime.Sum, r.stats.WriteWaits, r.stats.WriteWaitTime.Sum)
+	}
+
+	return w.Flush()
+}
+
+// alive reports whether a process with the given
+// process ID exists.
+func alive(pid int) bool {
+	if pid <= 0 {
+		return true
+	}
+
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+func liveness(pid int) string {
+	if alive(pid) {
+		return "running"
+	}
+
+	return "dead"
+}
+
+// generationOf returns the name of the resizable
+// shared memory that name holds a later generation of,
+// as NAME.GEN, or "" if it is not a generation of any
+// shared memory in headers.
+func generationOf(name string, headers map[string]shm.Header) string {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+
+	gen, err := strconv.ParseUint(name[i+1:], 10, 32)
+	if err != nil || gen == 0 {
+		return ""
+	}
+
+	if h, ok := headers[name[:i]]; ok && uint64(h.Generation) >= gen {
+		return name[:i]
+	}
+
+	return ""
+}
+
+func gc(dryRun bool) error {
+	headers := make(map[string]shm.Header)
+
+	if err := observe(func(o *shm.Observer) error {
+		headers[o.Name()] = o.Header()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range garbage(headers) {
+		if dryRun {
+			fmt.Printf("would remove %s\n", name)
+			continue
+		}
+
+		if err := shm.Unlink(name); err != nil {
+			return err
+		}
+
+		fmt.Printf("removed %s\n", name)
+	}
+
+	return nil
+}
+
+// garbage returns the names in headers that gc should
+// remove, in the order they should be removed.
+func garbage(headers map[string]shm.Header) []string {
+	// A resizable shared memory and its generations are
+	// removed together, and only once the creator of
+	// every generation has exited, as a peer may not yet
+	// have mapped the latest generation.
+	units := make(map[string][]string)
+
+	for name := range headers {
+		if root := generationOf(name, headers); root != "" {
+			units[root] = append(units[root], name)
+		} else {
+			units[name] = append(units[name], name)
+		}
+	}
+
+	roots := make([]string, 0, len(units))
+	for root := range units {
+		roots = append(roots, root)
+	}
+
+	sort.Strings(roots)
+
+	var remove []string
+
+	for _, root := range roots {
+		names := units[root]
+
+		live := false
+		for _, name := range names {
+			h := headers[name]
+			live = live || alive(h.CreatorPID) || alive(h.RootCreatorPID)
+		}
+
+		if live {
+			continue
+		}
+
+		sort.Strings(names)
+		remove = append(remove, names...)
+	}
+
+	return remove
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// deadPID returns the process ID of a process that has
+// exited.
+func deadPID(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return cmd.Process.Pid
+}
+
+func TestNormalise(t *testing.T) {
+	for name, expect := range map[string]string{
+		"ring":  "/ring",
+		"/ring": "/ring",
+	} {
+		if got := normalise(name); got != expect {
+			t.Errorf("normalise(%q) returned %q, expected %q", name, got, expect)
+		}
+	}
+}
+
+// TestGarbage checks that gc removes shared memory
+// whose creator has exited, and that a resizable shared
+// memory and its generations are only removed together
+// once every creator has exited.
+func TestGarbage(t *testing.T) {
+	dead, live := deadPID(t), os.Getpid()
+
+	headers := map[string]shm.Header{
+		"/dead": {CreatorPID: dead, RootCreatorPID: dead},
+		"/live": {CreatorPID: live, RootCreatorPID: live},
+
+		// Generation 2 was created by a live process
+		// that resized it, a peer may not yet have moved
+		// on to it.
+		"/resized":   {Generation: 2, CreatorPID: live, RootCreatorPID: dead},
+		"/resized.1": {Generation: 1, CreatorPID: dead, RootCreatorPID: dead},
+		"/resized.2": {Generation: 2, CreatorPID: live, RootCreatorPID: dead},
+
+		// The root was created by a live process, but
+		// was resized by one that has exited.
+		"/reopened":   {Generation: 1, CreatorPID: dead, RootCreatorPID: live},
+		"/reopened.1": {Generation: 1, CreatorPID: dead, RootCreatorPID: live},
+
+		"/stale":   {Generation: 1, CreatorPID: dead, RootCreatorPID: dead},
+		"/stale.1": {Generation: 1, CreatorPID: dead, RootCreatorPID: dead},
+
+		// A later generation is not a generation of
+		// shared memory that was never resized that far.
+		"/short":   {CreatorPID: live, RootCreatorPID: live},
+		"/short.1": {CreatorPID: dead, RootCreatorPID: dead},
+	}
+
+	expect := []string{"/dead", "/short.1", "/stale", "/stale.1"}
+	if got := garbage(headers); !reflect.DeepEqual(got, expect) {
+		t.Errorf("garbage returned %q, expected %q", got, expect)
+	}
+}
+
+// TestGenerationOf checks that the generations of
+// resizable shared memory are matched to their root.
+func TestGenerationOf(t *testing.T) {
+	name := fmt.Sprintf("/shm-go-shmctl-test-%d", os.Getpid())
+
+	rw, err := shm.CreateSimplexWithOptions(name, 0600, 4, 64, &shm.CreateOptions{
+		Resizable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if err := rw.Resize(8, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]shm.Header)
+	for _, name := range []string{name, name + ".1"} {
+		o, err := shm.OpenObserver(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers[name] = o.Header()
+		o.Close()
+	}
+
+	if h := headers[name]; h.Generation != 1 || h.RootCreatorPID != os.Getpid() {
+		t.Fatalf("Header returned %+v, expected generation 1 created by %d", h, os.Getpid())
+	}
+
+	if got := generationOf(name+".1", headers); got != name {
+		t.Errorf("generationOf(%q) returned %q, expected %q", name+".1", got, name)
+	}
+
+	if got := generationOf(name, headers); got != "" {
+		t.Errorf("generationOf(%q) returned %q, expected none", name, got)
+	}
+
+	if got := garbage(headers); len(got) != 0 {
+		t.Errorf("garbage returned %q for shared memory in use", got)
+	}
+}
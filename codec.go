@@ -0,0 +1,329 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// moreFlagMask is set on every block of a message
+	// but the last.
+	moreFlagIndex = 0
+	moreFlagMask  = 0x08
+
+	// cancelFlagMask is set on the last block of a
+	// message that could not be encoded, readers discard
+	// the message.
+	cancelFlagIndex = 0
+	cancelFlagMask  = 0x10
+)
+
+var errCancelled = errors.New("shm: message was cancelled by the writer")
+
+// Codec serialises values to and from a stream of
+// bytes. Each message is encoded and decoded on its
+// own, r returns io.EOF at the end of the message.
+//
+// Adapters for other formats, such as protobuf or
+// msgpack, need only marshal v and write the result to
+// w, and read all of r and unmarshal it into v.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+var (
+	// GobCodec encodes values with encoding/gob. As each
+	// message is decoded on its own, type information is
+	// sent with every message.
+	GobCodec Codec = gobCodec{}
+
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+)
+
+// Encoder writes values to a ReadWriteCloser with a
+// Codec. Values are serialised directly into
+// Buffer.Data, spilling into as many blocks as they
+// need.
+//
+// A message that spans several blocks can only be
+// reassembled if its blocks are read in order by a
+// single reader, so the ring must have one Encoder
+// and one Decoder. An Encoder is safe for concurrent
+// use.
+type Encoder struct {
+	rw    *ReadWriteCloser
+	codec Codec
+
+	mu sync.Mutex
+
+	// broken is set once a message has been left
+	// unterminated, after which the stream cannot be
+	// decoded.
+	broken bool
+}
+
+// NewEncoder returns an Encoder that writes to rw.
+func NewEncoder(rw *ReadWriteCloser, codec Codec) *Encoder {
+	return &Encoder{rw: rw, codec: codec}
+}
+
+// Encode sends v as a single message.
+//
+// If the last block of a message that spans several
+// blocks cannot be sent, the reader would take the
+// next message as part of it. Encode returns the error
+// that prevented it from being sent, and ErrStreamBroken
+// from then on.
+func (e *Encoder) Encode(v interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.broken {
+		return ErrStreamBroken
+	}
+
+	w := &messageWriter{rw: e.rw, open: true}
+
+	err := e.codec.Encode(w, v)
+	if err != nil {
+		if cerr := w.cancel(); cerr != nil {
+			err = cerr
+		}
+	} else {
+		err = w.close()
+	}
+
+	e.broken = err != nil && w.sent && w.open
+	return err
+}
+
+// messageWriter writes a message into consecutive
+// blocks.
+type messageWriter struct {
+	rw *ReadWriteCloser
+
+	buf     Buffer
+	started bool
+	sent    bool
+
+	// open is set until the last block of the message
+	// has been sent.
+	open bool
+}
+
+func (w *messageWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if !w.started {
+			if w.buf, err = w.rw.GetWriteBuffer(); err != nil {
+				return n, err
+			}
+
+			w.started = true
+		}
+
+		if len(w.buf.Data) == cap(w.buf.Data) {
+			w.buf.Flags[moreFlagIndex] |= moreFlagMask
+
+			w.started = false
+			if _, err = w.rw.SendWriteBuffer(w.buf); err != nil {
+				return n, err
+			}
+
+			w.sent = true
+			continue
+		}
+
+		nn := copy(w.buf.Data[len(w.buf.Data):cap(w.buf.Data)], p)
+		w.buf.Data = w.buf.Data[:len(w.buf.Data)+nn]
+
+		n += nn
+		p = p[nn:]
+	}
+
+	return n, nil
+}
+
+// close sends the last block of the message.
+func (w *messageWriter) close() error {
+	if !w.started {
+		var err error
+		if w.buf, err = w.rw.GetWriteBuffer(); err != nil {
+			return err
+		}
+	}
+
+	w.started = false
+	if _, err := w.rw.SendWriteBuffer(w.buf); err != nil {
+		return err
+	}
+
+	w.open = false
+	return nil
+}
+
+// cancel abandons the message. If any block has already
+// been sent, the last block is sent with cancelFlagMask
+// so that the reader discards what it has read.
+func (w *messageWriter) cancel() error {
+	if !w.sent {
+		if w.started {
+			w.started = false
+			return w.rw.AbortWriteBuffer(w.buf)
+		}
+
+		return nil
+	}
+
+	if !w.started {
+		var err error
+		if w.buf, err = w.rw.GetWriteBuffer(); err != nil {
+			return err
+		}
+	}
+
+	w.buf.Data = w.buf.Data[:0]
+	w.buf.Flags[cancelFlagIndex] |= cancelFlagMask
+
+	w.started = false
+	if _, err := w.rw.SendWriteBuffer(w.buf); err != nil {
+		return err
+	}
+
+	w.open = false
+	return nil
+}
+
+// Decoder reads values written by an Encoder from a
+// ReadWriteCloser. See Encoder for the restrictions on
+// its use. A Decoder is safe for concurrent use.
+type Decoder struct {
+	rw    *ReadWriteCloser
+	codec Codec
+
+	mu sync.Mutex
+}
+
+// NewDecoder returns a Decoder that reads from rw.
+func NewDecoder(rw *ReadWriteCloser, codec Codec) *Decoder {
+	return &Decoder{rw: rw, codec: codec}
+}
+
+// Decode receives the next message and decodes it into
+// v. Messages cancelled by the Encoder are skipped.
+func (d *Decoder) Decode(v interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		r := &messageReader{rw: d.rw}
+
+		err := d.codec.Decode(r, v)
+
+		// The codec need not have read the whole message.
+		if derr := r.discard(); errors.Is(derr, errCancelled) {
+			continue
+		} else if derr != nil {
+			return derr
+		}
+
+		if errors.Is(err, errCancelled) {
+			continue
+		}
+
+		return err
+	}
+}
+
+// messageReader reads a message from consecutive
+// blocks, it returns io.EOF after the last.
+type messageReader struct {
+	rw *ReadWriteCloser
+
+	buf     Buffer
+	started bool
+	done    bool
+	off     int
+}
+
+func (r *messageReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if !r.started {
+			if r.buf, err = r.rw.GetReadBuffer(); err != nil {
+				r.done = true
+				return 0, err
+			}
+
+			r.started, r.off = true, 0
+
+			if r.buf.Flags[cancelFlagIndex]&cancelFlagMask != 0 {
+				r.release()
+				return 0, errCancelled
+			}
+		}
+
+		if r.off < len(r.buf.Data) {
+			n = copy(p, r.buf.Data[r.off:])
+			r.off += n
+			return n, nil
+		}
+
+		if err = r.release(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// release sends the current block back to the ring and
+// notes whether it was the last of the message.
+func (r *messageReader) release() error {
+	r.done = r.buf.Flags[moreFlagIndex]&moreFlagMask == 0
+	r.started = false
+	return r.rw.SendReadBuffer(r.buf)
+}
+
+// discard releases the rest of the message.
+func (r *messageReader) discard() error {
+	var buf [512]byte
+
+	for {
+		if _, err := r.Read(buf[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
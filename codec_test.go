@@ -0,0 +1,157 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type codecValue struct {
+	ID   int
+	Text string
+}
+
+// TestCodec checks that values, including those that
+// span many blocks, are decoded as they were encoded.
+func TestCodec(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		codec Codec
+	}{
+		{"gob", GobCodec},
+		{"json", JSONCodec},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := createRing(t, 4, 64)
+
+			values := []codecValue{
+				{1, "short"},
+				{2, strings.Repeat("spans many blocks ", 100)},
+				{3, ""},
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				enc := NewEncoder(rw, tc.codec)
+
+				for _, v := range values {
+					if err := enc.Encode(v); err != nil {
+						errc <- err
+						return
+					}
+				}
+
+				errc <- nil
+			}()
+
+			dec := NewDecoder(rw, tc.codec)
+
+			for _, want := range values {
+				var got codecValue
+				if err := dec.Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Decode returned %+v, expected %+v", got, want)
+				}
+			}
+
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+var errEncode = errors.New("encode failed")
+
+// encodeFunc is a Codec that encodes with itself and
+// decodes with JSONCodec.
+type encodeFunc func(w io.Writer) error
+
+func (fn encodeFunc) Encode(w io.Writer, v interface{}) error {
+	return fn(w)
+}
+
+func (encodeFunc) Decode(r io.Reader, v interface{}) error {
+	return JSONCodec.Decode(r, v)
+}
+
+// TestEncoderCancel checks that a message the codec
+// fails to encode is never decoded, whether or not any
+// of its blocks had been sent.
+func TestEncoderCancel(t *testing.T) {
+	for _, n := range []int{0, 10, 64, 200} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			rw := createRing(t, 8, 64)
+
+			fail := encodeFunc(func(w io.Writer) error {
+				w.Write(make([]byte, n))
+				return errEncode
+			})
+
+			if err := NewEncoder(rw, fail).Encode(nil); err != errEncode {
+				t.Fatalf("Encode returned %v, expected %v", err, errEncode)
+			}
+
+			want := codecValue{1, "after"}
+			if err := NewEncoder(rw, JSONCodec).Encode(want); err != nil {
+				t.Fatal(err)
+			}
+
+			var got codecValue
+			if err := NewDecoder(rw, JSONCodec).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got != want {
+				t.Errorf("Decode returned %+v, expected %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestEncoderBroken checks that an Encoder refuses to
+// send further messages once it has left one
+// unterminated.
+func TestEncoderBroken(t *testing.T) {
+	rw := createRing(t, 8, 64)
+
+	// Once the first block is sent, no other can be
+	// taken, not even to cancel the message.
+	enc := NewEncoder(rw, encodeFunc(func(w io.Writer) error {
+		w.Write(make([]byte, 64))
+		atomic.StoreUint32((*uint32)(&rw.root.rings[0].shared.WriteStart), 100)
+
+		_, err := w.Write(make([]byte, 1))
+		return err
+	}))
+
+	if err := enc.Encode(nil); err != ErrInvalidSharedMemory {
+		t.Fatalf("Encode returned %v, expected %v", err, ErrInvalidSharedMemory)
+	}
+
+	if err := enc.Encode(nil); err != ErrStreamBroken {
+		t.Errorf("Encode returned %v, expected %v", err, ErrStreamBroken)
+	}
+
+	// A message that was never started leaves the
+	// stream intact.
+	enc = NewEncoder(rw, JSONCodec)
+
+	for i := 0; i < 2; i++ {
+		if err := enc.Encode(codecValue{}); err != ErrInvalidSharedMemory {
+			t.Fatalf("Encode returned %v, expected %v", err, ErrInvalidSharedMemory)
+		}
+	}
+}
@@ -5,158 +5,119 @@
 
 package shm
 
-import (
-	"golang.org/x/sys/unix"
-	"os"
-	"sync/atomic"
-	"unsafe"
-
-	"github.com/tmthrgd/go-sem"
-	"github.com/tmthrgd/go-shm"
-)
+import "os"
+
+// CreateOptions holds the optional parameters accepted by
+// CreateSimplexWithOptions and CreateDuplexWithOptions.
+type CreateOptions struct {
+	// Metadata is an application-defined descriptor, such
+	// as a protocol name, schema hash or producer ID, that
+	// is stored alongside the ring. It is exposed read-only
+	// by (*ReadWriteCloser).Metadata.
+	Metadata []byte
+
+	// Timestamps causes SendWriteBuffer to record when
+	// each block was sent, in every attached process.
+	// It is exposed to readers as Buffer.PublishedAt.
+	Timestamps bool
+
+	// Resizable allows the block count and block size
+	// to be changed after creation with
+	// (*ReadWriteCloser).Resize. Resizable shared memory
+	// cannot be opened by older versions of this
+	// package.
+	Resizable bool
+
+	// Overwrite causes GetWriteBuffer to overwrite the
+	// oldest unread block, rather than wait, when the
+	// ring is full. Readers learn how many blocks they
+	// lost from Buffer.Lost. Blocks already taken by a
+	// reader are never overwritten. Overwrite shared
+	// memory cannot be opened by older versions of this
+	// package.
+	Overwrite bool
+
+	// Slab adds a slab region to the shared memory, with
+	// Count slots of Size bytes for each class, from which
+	// large payloads may be allocated with
+	// (*ReadWriteCloser).Alloc. Shared memory with a slab
+	// region cannot be opened by older versions of this
+	// package.
+	Slab []SlabClass
+}
 
 func CreateSimplex(name string, perm os.FileMode, blockCount, blockSize int) (*ReadWriteCloser, error) {
-	if blockSize&0x3f != 0 {
-		return nil, ErrNotMultipleOf64
-	}
-
-	file, err := shm.Open(name, unix.O_CREAT|unix.O_EXCL|unix.O_TRUNC|unix.O_RDWR, perm)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
-
-	fullBlockSize := blockHeaderSize + uint64(blockSize)
-	size := sharedHeaderSize + fullBlockSize*uint64(blockCount)
-
-	if err = file.Truncate(int64(size)); err != nil {
-		return nil, err
-	}
-
-	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-
-	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
-
-	/*
-	 * memset already set:
-	 *	shared.ReadStart, shared.ReadEnd = 0, 0
-	 *	shared.WriteStart, shared.WriteEnd = 0, 0
-	 *	shared.block[i].Size = 0
-	 *	shared.block[i].DoneRead, shared.block[i].DoneWrite = 0, 0
-	 */
-	*(*uint32)(&shared.BlockCount), *(*uint64)(&shared.BlockSize) = uint32(blockCount), uint64(blockSize)
-
-	if err = ((*sem.Semaphore)(&shared.SemSignal)).Init(0); err != nil {
-		return nil, err
-	}
-
-	if err = ((*sem.Semaphore)(&shared.SemAvail)).Init(0); err != nil {
-		return nil, err
-	}
-
-	for i := uint32(0); i < uint32(blockCount); i++ {
-		block := (*sharedBlock)(unsafe.Pointer(&data[sharedHeaderSize+uint64(i)*fullBlockSize]))
-
-		switch i {
-		case 0:
-			block.Next, *(*uint32)(&block.Prev) = 1, uint32(blockCount-1)
-		case uint32(blockCount - 1):
-			block.Next, *(*uint32)(&block.Prev) = 0, uint32(blockCount-2)
-		default:
-			*(*uint32)(&block.Next), *(*uint32)(&block.Prev) = i+1, i-1
-		}
-	}
-
-	atomic.StoreUint32((*uint32)(&shared.Version), version)
-
-	return &ReadWriteCloser{
-		name: name,
-
-		data:          data,
-		readShared:    shared,
-		writeShared:   shared,
-		size:          size,
-		fullBlockSize: fullBlockSize,
+	return CreateSimplexWithOptions(name, perm, blockCount, blockSize, nil)
+}
 
-		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
-	}, nil
+// CreateSimplexWithOptions is like CreateSimplex but
+// accepts a set of optional parameters. opts may be nil.
+func CreateSimplexWithOptions(name string, perm os.FileMode, blockCount, blockSize int, opts *CreateOptions) (*ReadWriteCloser, error) {
+	g := geometry{uint64(blockCount), uint64(blockSize)}
+	return create(name, perm, [2]geometry{g, g}, opts, 0)
 }
 
 func CreateDuplex(name string, perm os.FileMode, blockCount, blockSize int) (*ReadWriteCloser, error) {
-	if blockSize&0x3f != 0 {
-		return nil, ErrNotMultipleOf64
-	}
-
-	file, err := shm.Open(name, unix.O_CREAT|unix.O_EXCL|unix.O_TRUNC|unix.O_RDWR, perm)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
+	return CreateDuplexWithOptions(name, perm, blockCount, blockSize, nil)
+}
 
-	fullBlockSize := blockHeaderSize + uint64(blockSize)
-	sharedSize := sharedHeaderSize + fullBlockSize*uint64(blockCount)
-	size := 2 * sharedSize
+// CreateDuplexWithOptions is like CreateDuplex but
+// accepts a set of optional parameters. opts may be nil.
+func CreateDuplexWithOptions(name string, perm os.FileMode, blockCount, blockSize int, opts *CreateOptions) (*ReadWriteCloser, error) {
+	g := geometry{uint64(blockCount), uint64(blockSize)}
+	return create(name, perm, [2]geometry{g, g}, opts, featureDuplex)
+}
 
-	if err = file.Truncate(int64(size)); err != nil {
-		return nil, err
-	}
+// CreateDuplexAsymmetric is like CreateDuplex but
+// allows each direction to have its own block count
+// and block size.
+//
+// Requests are written by the process that calls
+// OpenDuplex and read by the creator, responses are
+// written by the creator. Shared memory with differing
+// directions cannot be opened by older versions of
+// this package.
+func CreateDuplexAsymmetric(name string, perm os.FileMode, reqCount, reqSize, respCount, respSize int) (*ReadWriteCloser, error) {
+	return CreateDuplexAsymmetricWithOptions(name, perm, reqCount, reqSize, respCount, respSize, nil)
+}
 
-	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
+// CreateDuplexAsymmetricWithOptions is like
+// CreateDuplexAsymmetric but accepts a set of optional
+// parameters. opts may be nil.
+func CreateDuplexAsymmetricWithOptions(name string, perm os.FileMode, reqCount, reqSize, respCount, respSize int, opts *CreateOptions) (*ReadWriteCloser, error) {
+	return create(name, perm, [2]geometry{
+		{uint64(reqCount), uint64(reqSize)},
+		{uint64(respCount), uint64(respSize)},
+	}, opts, featureDuplex)
+}
 
-	for i := uint64(0); i < 2; i++ {
-		shared := (*sharedMem)(unsafe.Pointer(&data[i*sharedSize]))
+func create(name string, perm os.FileMode, rings [2]geometry, opts *CreateOptions, features uint32) (*ReadWriteCloser, error) {
+	var (
+		metadata []byte
+		slab     []SlabClass
+		incompat uint32
+	)
 
-		/*
-		 * memset already set:
-		 *	shared.ReadStart, shared.ReadEnd = 0, 0
-		 *	shared.WriteStart, shared.WriteEnd = 0, 0
-		 *	shared.Blocks[i].Size = 0
-		 *	shared.Blocks[i].DoneRead, shared.Blocks[i].DoneWrite = 0, 0
-		 */
-		*(*uint32)(&shared.BlockCount), *(*uint64)(&shared.BlockSize) = uint32(blockCount), uint64(blockSize)
+	if opts != nil {
+		metadata, slab = opts.Metadata, opts.Slab
 
-		if err = ((*sem.Semaphore)(&shared.SemSignal)).Init(0); err != nil {
-			return nil, err
+		if opts.Timestamps {
+			features |= featureTimestamps
 		}
 
-		if err = ((*sem.Semaphore)(&shared.SemAvail)).Init(0); err != nil {
-			return nil, err
+		if opts.Resizable {
+			incompat |= incompatResizable
 		}
 
-		for j := uint32(0); j < uint32(blockCount); j++ {
-			block := (*sharedBlock)(unsafe.Pointer(&data[i*sharedSize+sharedHeaderSize+uint64(j)*fullBlockSize]))
-
-			switch j {
-			case 0:
-				block.Next, *(*uint32)(&block.Prev) = 1, uint32(blockCount-1)
-			case uint32(blockCount - 1):
-				block.Next, *(*uint32)(&block.Prev) = 0, uint32(blockCount-2)
-			default:
-				*(*uint32)(&block.Next), *(*uint32)(&block.Prev) = j+1, j-1
-			}
+		if opts.Overwrite {
+			incompat |= incompatOverwrite
 		}
 	}
 
-	readShared := (*sharedMem)(unsafe.Pointer(&data[0]))
-	atomic.StoreUint32((*uint32)(&readShared.Version), version)
-
-	return &ReadWriteCloser{
-		name: name,
-
-		data:          data,
-		readShared:    readShared,
-		writeShared:   (*sharedMem)(unsafe.Pointer(&data[sharedSize])),
-		size:          size,
-		fullBlockSize: fullBlockSize,
+	root, err := createSegment(name, 0, perm, rings, sharedHeaderSize, slab, metadata, features, incompat)
+	if err != nil {
+		return nil, err
+	}
 
-		Flags: (*[len(readShared.Flags)]uint32)(unsafe.Pointer(&readShared.Flags[0])),
-	}, nil
+	return newReadWriteCloser(name, root, true), nil
 }
@@ -0,0 +1,265 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestCreateInvalidGeometry checks that geometry which
+// cannot be mapped, or would not form a ring, is
+// rejected rather than panicking.
+func TestCreateInvalidGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		blockCount, size int
+	}{
+		{"negative size", 4, -64},
+		{"negative count", -4, 64},
+		{"no blocks", 0, 64},
+		{"one block", 1, 64},
+		{"overflowing size", 4, math.MaxInt &^ 0x3f},
+		{"overflowing ring", math.MaxUint32 >> 1, 1 << 30},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rw, err := CreateSimplex(testName(t), 0600, tc.blockCount, tc.size)
+			if err == nil {
+				rw.Unlink()
+				rw.Close()
+				t.Fatal("CreateSimplex succeeded")
+			}
+		})
+	}
+}
+
+// TestMetadata checks that metadata passed to Create is
+// returned by Metadata in both the creating and the
+// opening process, and still after Close.
+func TestMetadata(t *testing.T) {
+	name := testName(t)
+	metadata := []byte("application/x-test; schema=42")
+
+	rw, err := CreateDuplexWithOptions(name, 0600, 4, 64, &CreateOptions{
+		Metadata: metadata,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Unlink()
+
+	peer, err := OpenDuplex(name)
+	if err != nil {
+		rw.Close()
+		t.Fatal(err)
+	}
+
+	for _, c := range []*ReadWriteCloser{rw, peer} {
+		if got := c.Metadata(); !bytes.Equal(got, metadata) {
+			t.Errorf("Metadata returned %q, expected %q", got, metadata)
+		}
+	}
+
+	// Metadata returns a copy that the caller may modify.
+	rw.Metadata()[0] = 'X'
+	if got := peer.Metadata(); !bytes.Equal(got, metadata) {
+		t.Errorf("Metadata returned %q after modifying a copy, expected %q", got, metadata)
+	}
+
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata must not be read from the mapping once
+	// it has been unmapped.
+	if got := peer.Metadata(); !bytes.Equal(got, metadata) {
+		t.Errorf("Metadata returned %q after Close, expected %q", got, metadata)
+	}
+}
+
+// TestNoMetadata checks that Metadata returns nil if none
+// was set.
+func TestNoMetadata(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if got := rw.Metadata(); got != nil {
+		t.Errorf("Metadata returned %q, expected nil", got)
+	}
+}
+
+// TestTimestamps checks that blocks are stamped with the
+// time they were sent, by every process attached to
+// shared memory created with Timestamps, and only then.
+func TestTimestamps(t *testing.T) {
+	for _, timestamps := range []bool{true, false} {
+		t.Run(fmt.Sprint(timestamps), func(t *testing.T) {
+			name := testName(t)
+
+			rw, err := CreateSimplexWithOptions(name, 0600, 4, 64, &CreateOptions{
+				Timestamps: timestamps,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Close()
+			defer rw.Unlink()
+
+			// The writer learns of Timestamps from the
+			// header, not from CreateOptions.
+			peer, err := OpenSimplex(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			before := Monotonic()
+
+			if _, err := peer.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			after := Monotonic()
+
+			buf, err := rw.GetReadBuffer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.SendReadBuffer(buf)
+
+			switch {
+			case !timestamps && buf.PublishedAt != 0:
+				t.Errorf("PublishedAt was %d, expected 0", buf.PublishedAt)
+			case timestamps && (buf.PublishedAt < before || buf.PublishedAt > after):
+				t.Errorf("PublishedAt was %d, expected it in [%d, %d]", buf.PublishedAt, before, after)
+			}
+		})
+	}
+}
+
+// TestDuplexAsymmetric checks that each direction of
+// asymmetric duplex shared memory has its own geometry,
+// as seen from both ends.
+func TestDuplexAsymmetric(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateDuplexAsymmetric(name, 0600, 4, 64, 16, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	peer, err := OpenDuplex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		name string
+		rw   *ReadWriteCloser
+
+		read, write [2]int
+	}{
+		{"creator", rw, [2]int{4, 64}, [2]int{16, 256}},
+		{"peer", peer, [2]int{16, 256}, [2]int{4, 64}},
+	} {
+		s := tc.rw.Stats()
+
+		if got := [2]int{s.Read.BlockCount, s.Read.BlockSize}; got != tc.read {
+			t.Errorf("%s reads %d blocks of %d bytes, expected %d of %d", tc.name, got[0], got[1], tc.read[0], tc.read[1])
+		}
+
+		if got := [2]int{s.Write.BlockCount, s.Write.BlockSize}; got != tc.write {
+			t.Errorf("%s writes %d blocks of %d bytes, expected %d of %d", tc.name, got[0], got[1], tc.write[0], tc.write[1])
+		}
+
+		buf, err := tc.rw.GetWriteBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cap(buf.Data) != tc.write[1] {
+			t.Errorf("%s has write buffers of %d bytes, expected %d", tc.name, cap(buf.Data), tc.write[1])
+		}
+
+		buf.Data = buf.Data[:cap(buf.Data)]
+		if _, err := tc.rw.SendWriteBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each end reads the full block written by the other.
+	for _, tc := range []struct {
+		rw   *ReadWriteCloser
+		size int
+	}{{rw, 64}, {peer, 256}} {
+		buf, err := tc.rw.GetReadBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(buf.Data) != tc.size {
+			t.Errorf("read %d bytes, expected %d", len(buf.Data), tc.size)
+		}
+
+		if err := tc.rw.SendReadBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rw.root.incompat&incompatAsymmetric == 0 {
+		t.Error("asymmetric shared memory does not have incompatAsymmetric set")
+	}
+}
+
+// TestDuplexSymmetric checks that shared memory whose
+// directions match can still be opened by older
+// versions of this package.
+func TestDuplexSymmetric(t *testing.T) {
+	rw, err := CreateDuplexAsymmetric(testName(t), 0600, 4, 64, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if rw.root.incompat&incompatAsymmetric != 0 {
+		t.Error("symmetric shared memory has incompatAsymmetric set")
+	}
+}
+
+// TestDuplexAsymmetricInvalidGeometry checks that the
+// geometry of the response ring is validated too.
+func TestDuplexAsymmetricInvalidGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		respCount, respSize int
+	}{
+		{"one block", 1, 64},
+		{"negative size", 4, -64},
+		{"unaligned size", 4, 65},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rw, err := CreateDuplexAsymmetric(testName(t), 0600, 4, 64, tc.respCount, tc.respSize)
+			if err == nil {
+				rw.Unlink()
+				rw.Close()
+				t.Fatal("CreateDuplexAsymmetric succeeded")
+			}
+		})
+	}
+}
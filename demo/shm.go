@@ -15,7 +15,6 @@ import (
 	"hash/crc32"
 	"html"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,7 +23,7 @@ import (
 	"syscall"
 
 	"github.com/tmthrgd/shm-go"
-	shmNet "github.com/tmthrgd/shm-go/net"
+	shmHTTP "github.com/tmthrgd/shm-go/http"
 )
 
 const shmName = "/shm-go"
@@ -163,11 +162,8 @@ func main() {
 				fmt.Fprintf(w, "Hello, %q\n", html.EscapeString(r.URL.Path))
 			})
 
-			ln := shmNet.NewListener(rw, shmName)
-
 			go func() {
-				// TODO(tmthrgd): More efficiant shared memory http server
-				must("http.Serve", http.Serve(ln, nil))
+				must("shmHTTP.Serve", shmHTTP.Serve(rw, nil))
 			}()
 
 		} else {
@@ -175,15 +171,9 @@ func main() {
 			must("OpenDuplex", err)
 			closer = rw
 
-			tr := &http.Transport{
-				Dial: func(n, a string) (net.Conn, error) {
-					return shmNet.NewDialer(rw, shmName).Dial("shm", shmName)
-				},
-			}
-
-			//tr.RegisterProtocol("shm", )
+			tr := &http.Transport{}
+			tr.RegisterProtocol("shm", shmHTTP.NewTransport(rw))
 
-			// TODO(tmthrgd): More efficiant shared memory http client
 			client := &http.Client{
 				Transport: tr,
 			}
@@ -195,7 +185,7 @@ func main() {
 			term := terminal.NewTerminal(os.Stdin, "> ")
 
 			base := &url.URL{
-				Scheme: "http",
+				Scheme: "shm",
 				Host:   "localhost",
 			}
 
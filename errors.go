@@ -11,4 +11,25 @@ var (
 	ErrInvalidSharedMemory = errors.New("invalid shared memory")
 	ErrNotMultipleOf64     = errors.New("blockSize is not a multiple of 64")
 	ErrInvalidBuffer       = errors.New("invalid buffer")
+	ErrMetadataTooLarge    = errors.New("metadata is too large")
+	ErrNotReady            = errors.New("no block is ready")
+	ErrNotResizable        = errors.New("shared memory is not resizable")
+	ErrResized             = errors.New("shared memory is already being resized")
+	ErrBroadcast           = errors.New("shared memory is a broadcast ring")
+	ErrNotBroadcast        = errors.New("shared memory is not a broadcast ring")
+	ErrDropped             = errors.New("subscriber was dropped for falling behind")
+	ErrTooManySubscribers  = errors.New("too many subscribers")
+	ErrMailbox             = errors.New("shared memory is a mailbox")
+	ErrNotMailbox          = errors.New("shared memory is not a mailbox")
+	ErrSnapshotTooLarge    = errors.New("snapshot is too large for the mailbox")
+	ErrSnapshotAbandoned   = errors.New("snapshot was abandoned by a writer that exited")
+	ErrInvalidSlabClass    = errors.New("invalid slab class")
+	ErrNoSlab              = errors.New("shared memory has no slab region")
+	ErrSlabFull            = errors.New("no slab slot is free")
+	ErrPayloadTooLarge     = errors.New("payload is larger than every slab class")
+	ErrInvalidPayload      = errors.New("invalid payload")
+	ErrDoubleFree          = errors.New("payload has already been freed")
+	ErrNotPlainType        = errors.New("type is not of fixed layout or holds pointers")
+	ErrTypeTooLarge        = errors.New("type is larger than a block")
+	ErrStreamBroken        = errors.New("stream holds an unterminated message")
 )
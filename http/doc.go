@@ -0,0 +1,19 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Package http carries HTTP requests and responses over
+// a duplex shared memory, without the byte stream of
+// package net.
+//
+// Each block holds one frame of one request's stream,
+// so any number of requests may be in flight at once.
+// Heads are sent in a compact binary form, and bodies
+// are streamed in as many blocks as they need, with
+// per-stream flow control so that one slow reader does
+// not hold up the others.
+//
+// A shared memory is used by one Transport and one
+// Server.
+package http
@@ -0,0 +1,633 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// Each block holds a single frame, described by the
+// block's flags. The first byte of the flags is used by
+// package shm.
+const (
+	frameTypeIndex   = 1
+	frameFlagsIndex  = 2
+	frameIDIndex     = 4
+	frameCreditIndex = 8
+)
+
+const (
+	// frameHead carries the head of a request or
+	// response. It may span several frames.
+	frameHead = 1 + iota
+	// frameData carries part of a body.
+	frameData
+	// frameWindow grants the sender of a body the
+	// credit to send more frames.
+	frameWindow
+	// frameReset abandons a stream in both directions.
+	frameReset
+)
+
+const (
+	// flagMore is set on every frameHead of a head but
+	// the last.
+	flagMore = 0x01
+	// flagEnd is set on the last frame sent in one
+	// direction of a stream.
+	flagEnd = 0x02
+)
+
+// streamWindow is the number of frameData that may be
+// sent on a stream before the receiver grants more
+// credit. Bodies are copied out of the shared memory as
+// they arrive, so this bounds the memory held by a body
+// that is not being read.
+const streamWindow = 16
+
+// maxHeadBytes bounds the size of a head, which may span
+// any number of frames. It matches
+// http.DefaultMaxHeaderBytes.
+const maxHeadBytes = 1 << 20
+
+var (
+	errStreamReset     = errors.New("shm/http: stream reset by peer")
+	errStreamClosed    = errors.New("shm/http: stream closed")
+	errInvalidHead     = errors.New("shm/http: invalid head")
+	errWindowOverrun   = errors.New("shm/http: peer overran stream window")
+	errProtocol        = errors.New("shm/http: protocol violation by peer")
+	errTransportClosed = errors.New("shm/http: transport closed")
+)
+
+// conn multiplexes streams over a duplex shared memory.
+type conn struct {
+	rw        *shm.ReadWriteCloser
+	blockSize int
+
+	// accept is set by a Server, which creates a stream
+	// for each new head.
+	accept bool
+	onHead func(s *stream, head []byte, end bool)
+
+	mut     sync.Mutex
+	streams map[uint32]*stream
+	err     error
+
+	// resets holds the streams that reset has abandoned
+	// but that resetLoop has yet to tell the peer of.
+	// resetReady is signalled as it is added to.
+	resets     []uint32
+	resetReady chan struct{}
+
+	// ctx is cancelled by stop to stop readLoop and any
+	// wait for a block, stopped is closed once readLoop
+	// has returned.
+	ctx     context.Context
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+func newConn(rw *shm.ReadWriteCloser, accept bool, onHead func(s *stream, head []byte, end bool)) *conn {
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &conn{
+		rw:        rw,
+		blockSize: rw.Stats().Write.BlockSize,
+
+		accept: accept,
+		onHead: onHead,
+
+		streams: make(map[uint32]*stream),
+
+		resetReady: make(chan struct{}, 1),
+
+		ctx:     ctx,
+		stop:    stop,
+		stopped: make(chan struct{}),
+	}
+}
+
+// close stops readLoop and waits for it to return.
+func (c *conn) close() {
+	c.stop()
+	<-c.stopped
+}
+
+// stream is one request and its response.
+type stream struct {
+	c  *conn
+	id uint32
+
+	// head is the part of the head read so far, gotHead
+	// is set once all of it has been read. They are only
+	// used by the reading goroutine.
+	head    []byte
+	gotHead bool
+
+	chunks chan []byte
+	credit chan struct{}
+
+	// done is closed once the stream has ended in both
+	// directions or been reset, err holds the reason for
+	// a reset.
+	done chan struct{}
+	err  error
+
+	// sentEnd and recvEnd are set with c.mut held.
+	// recvEnd is only set by the reading goroutine, which
+	// may read it without c.mut.
+	sentEnd, recvEnd bool
+
+	// heads receives the response head for a Transport,
+	// cancel cancels the request context for a Server.
+	heads  chan []byte
+	cancel func()
+}
+
+func (c *conn) add(id uint32) (*stream, error) {
+	s := &stream{
+		c:  c,
+		id: id,
+
+		chunks: make(chan []byte, streamWindow),
+		credit: make(chan struct{}, streamWindow),
+		done:   make(chan struct{}),
+
+		heads: make(chan []byte, 1),
+	}
+
+	for i := 0; i < streamWindow; i++ {
+		s.credit <- struct{}{}
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.streams[id] = s
+	return s, nil
+}
+
+func (c *conn) get(id uint32) *stream {
+	c.mut.Lock()
+	s := c.streams[id]
+	c.mut.Unlock()
+	return s
+}
+
+// finish removes s, closing done. It must be called with
+// c.mut held.
+func (c *conn) finish(s *stream, err error) {
+	if c.streams[s.id] != s {
+		return
+	}
+
+	delete(c.streams, s.id)
+
+	s.err = err
+	close(s.done)
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// ended records that s has ended in one direction and
+// finishes it once it has ended in both.
+func (c *conn) ended(s *stream, sent bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if sent {
+		s.sentEnd = true
+	} else {
+		s.recvEnd = true
+	}
+
+	if s.sentEnd && s.recvEnd {
+		c.finish(s, nil)
+	}
+}
+
+// reset abandons s and tells the peer to do likewise.
+// The frameReset is sent by resetLoop, so reset never
+// waits for a block.
+func (c *conn) reset(s *stream, err error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.streams[s.id] == s {
+		c.resets = append(c.resets, s.id)
+
+		select {
+		case c.resetReady <- struct{}{}:
+		default:
+		}
+	}
+
+	c.finish(s, err)
+}
+
+// resetLoop sends a frameReset for each stream abandoned
+// by reset until readLoop returns. Were readLoop to send
+// them itself, two peers resetting streams at once over
+// full rings would each wait for the other to read.
+func (c *conn) resetLoop() {
+	for {
+		select {
+		case <-c.resetReady:
+		case <-c.ctx.Done():
+			return
+		}
+
+		c.mut.Lock()
+		ids := c.resets
+		c.resets = nil
+		c.mut.Unlock()
+
+		for _, id := range ids {
+			c.writeFrame(id, frameReset, 0, 0, nil)
+		}
+	}
+}
+
+// fail finishes every stream once reading from the
+// shared memory has failed.
+func (c *conn) fail(err error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.err = err
+
+	for _, s := range c.streams {
+		c.finish(s, err)
+	}
+}
+
+// closedErr returns errTransportClosed in place of the
+// error returned by a wait stopped by stop.
+func closedErr(err error) error {
+	if err == context.Canceled {
+		return errTransportClosed
+	}
+
+	return err
+}
+
+func (c *conn) writeFrame(id uint32, typ, flags byte, credit uint32, data []byte) error {
+	buf, err := c.rw.GetWriteBufferContext(c.ctx)
+	if err != nil {
+		return closedErr(err)
+	}
+
+	buf.Data = buf.Data[:copy(buf.Data[:cap(buf.Data)], data)]
+
+	buf.Flags[frameTypeIndex] = typ
+	buf.Flags[frameFlagsIndex] = flags
+	binary.LittleEndian.PutUint32(buf.Flags[frameIDIndex:], id)
+	binary.LittleEndian.PutUint32(buf.Flags[frameCreditIndex:], credit)
+
+	_, err = c.rw.SendWriteBuffer(buf)
+	return err
+}
+
+// writeHead sends head in as many frames as it needs.
+func (c *conn) writeHead(id uint32, head []byte, end bool) error {
+	for {
+		buf, err := c.rw.GetWriteBufferContext(c.ctx)
+		if err != nil {
+			return closedErr(err)
+		}
+
+		n := copy(buf.Data[:cap(buf.Data)], head)
+		buf.Data = buf.Data[:n]
+		head = head[n:]
+
+		var flags byte
+		if len(head) != 0 {
+			flags |= flagMore
+		} else if end {
+			flags |= flagEnd
+		}
+
+		buf.Flags[frameTypeIndex] = frameHead
+		buf.Flags[frameFlagsIndex] = flags
+		binary.LittleEndian.PutUint32(buf.Flags[frameIDIndex:], id)
+		binary.LittleEndian.PutUint32(buf.Flags[frameCreditIndex:], 0)
+
+		if _, err = c.rw.SendWriteBuffer(buf); err != nil || len(head) == 0 {
+			return err
+		}
+	}
+}
+
+// readLoop reads frames until reading from the shared
+// memory fails or stop is called. Frames for unknown
+// streams, such as those already reset, are dropped. A
+// stream whose frames break the protocol, such as by
+// sending data after its end, is reset.
+func (c *conn) readLoop() error {
+	resetsDone := make(chan struct{})
+	go func() {
+		c.resetLoop()
+		close(resetsDone)
+	}()
+
+	defer func() {
+		c.stop()
+		<-resetsDone
+		close(c.stopped)
+	}()
+
+	for {
+		// A block that is ready is returned even once
+		// ctx is done.
+		if c.ctx.Err() != nil {
+			c.fail(errTransportClosed)
+			return errTransportClosed
+		}
+
+		buf, err := c.rw.GetReadBufferContext(c.ctx)
+		if err != nil {
+			err = closedErr(err)
+
+			c.fail(err)
+			return err
+		}
+
+		typ := buf.Flags[frameTypeIndex]
+		flags := buf.Flags[frameFlagsIndex]
+		id := binary.LittleEndian.Uint32(buf.Flags[frameIDIndex:])
+
+		s := c.get(id)
+		if s == nil && typ == frameHead && c.accept {
+			if s, err = c.add(id); err != nil {
+				c.rw.SendReadBuffer(buf)
+				return err
+			}
+		}
+
+		var overrun, violation bool
+
+		if s != nil {
+			switch typ {
+			case frameHead:
+				if s.gotHead || s.recvEnd || flags&(flagMore|flagEnd) == flagMore|flagEnd ||
+					len(s.head)+len(buf.Data) > maxHeadBytes {
+					violation = true
+					break
+				}
+
+				s.head = append(s.head, buf.Data...)
+
+				if flags&flagMore == 0 {
+					head := s.head
+					s.head, s.gotHead = nil, true
+
+					c.onHead(s, head, flags&flagEnd != 0)
+				}
+			case frameData:
+				if !s.gotHead || s.recvEnd {
+					violation = true
+					break
+				}
+
+				select {
+				case s.chunks <- append([]byte(nil), buf.Data...):
+				default:
+					overrun = true
+				}
+			case frameWindow:
+				// Only readLoop adds credit, so more than the
+				// window has room for was never owed.
+				credit := binary.LittleEndian.Uint32(buf.Flags[frameCreditIndex:])
+				if credit > uint32(cap(s.credit)-len(s.credit)) {
+					violation = true
+					break
+				}
+
+				for i := uint32(0); i < credit; i++ {
+					s.credit <- struct{}{}
+				}
+			case frameReset:
+				c.mut.Lock()
+				c.finish(s, errStreamReset)
+				c.mut.Unlock()
+			}
+		}
+
+		if err = c.rw.SendReadBuffer(buf); err != nil {
+			c.fail(err)
+			return err
+		}
+
+		switch {
+		case violation:
+			c.reset(s, errProtocol)
+		case overrun:
+			c.reset(s, errWindowOverrun)
+		case s != nil && flags&flagEnd != 0 && (typ == frameHead || typ == frameData):
+			close(s.chunks)
+			c.ended(s, false)
+		}
+	}
+}
+
+// bodyWriter sends a body as frameData, each of which
+// is copied into a block and sent at once. Blocks are
+// never held while waiting on the caller, as that would
+// stall every other stream.
+type bodyWriter struct {
+	s *stream
+
+	// head, if not nil, is sent ahead of the first
+	// frameData.
+	head []byte
+}
+
+func (w *bodyWriter) waitCredit() error {
+	select {
+	case <-w.s.credit:
+		return nil
+	case <-w.s.done:
+		if w.s.err != nil {
+			return w.s.err
+		}
+
+		return errStreamClosed
+	}
+}
+
+func (w *bodyWriter) flushHead() error {
+	if w.head == nil {
+		return nil
+	}
+
+	head := w.head
+	w.head = nil
+	return w.s.c.writeHead(w.s.id, head, false)
+}
+
+func (w *bodyWriter) Write(p []byte) (n int, err error) {
+	if err = w.flushHead(); err != nil {
+		return 0, err
+	}
+
+	for len(p) > 0 {
+		if err = w.waitCredit(); err != nil {
+			return n, err
+		}
+
+		nn := len(p)
+		if nn > w.s.c.blockSize {
+			nn = w.s.c.blockSize
+		}
+
+		if err = w.s.c.writeFrame(w.s.id, frameData, 0, 0, p[:nn]); err != nil {
+			return n, err
+		}
+
+		n += nn
+		p = p[nn:]
+	}
+
+	return n, nil
+}
+
+// end ends the body. If the head has not yet been sent,
+// it is sent with flagEnd.
+func (w *bodyWriter) end() error {
+	if w.head != nil {
+		head := w.head
+		w.head = nil
+
+		if err := w.s.c.writeHead(w.s.id, head, true); err != nil {
+			return err
+		}
+	} else {
+		if err := w.waitCredit(); err != nil {
+			return err
+		}
+
+		if err := w.s.c.writeFrame(w.s.id, frameData, flagEnd, 0, nil); err != nil {
+			return err
+		}
+	}
+
+	w.s.c.ended(w.s, true)
+	return nil
+}
+
+// bodyReader reads a body received as frameData,
+// granting the sender more credit as it goes.
+type bodyReader struct {
+	s *stream
+
+	cur      []byte
+	consumed uint32
+	eof      bool
+}
+
+func (r *bodyReader) next() ([]byte, error) {
+	select {
+	case chunk, ok := <-r.s.chunks:
+		return chunk, chunkErr(ok)
+	case <-r.s.done:
+	}
+
+	// Prefer chunks that arrived ahead of a reset.
+	select {
+	case chunk, ok := <-r.s.chunks:
+		return chunk, chunkErr(ok)
+	default:
+	}
+
+	if r.s.err != nil {
+		return nil, r.s.err
+	}
+
+	return nil, errStreamClosed
+}
+
+func chunkErr(ok bool) error {
+	if !ok {
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (r *bodyReader) Read(p []byte) (n int, err error) {
+	for len(r.cur) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		if r.cur, err = r.next(); err == io.EOF {
+			r.eof = true
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+
+		if err = r.grant(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// grant returns credit for taken chunks to the sender
+// once half of the window has been taken.
+func (r *bodyReader) grant() error {
+	if r.consumed++; r.consumed < streamWindow/2 {
+		return nil
+	}
+
+	select {
+	case <-r.s.done:
+		return nil
+	default:
+	}
+
+	credit := r.consumed
+	r.consumed = 0
+	return r.s.c.writeFrame(r.s.id, frameWindow, 0, credit, nil)
+}
+
+// Close resets the stream if the body has not been
+// received in full.
+func (r *bodyReader) Close() error {
+	if r.eof {
+		return nil
+	}
+
+	r.eof = true
+
+	for {
+		select {
+		case _, ok := <-r.s.chunks:
+			if !ok {
+				return nil
+			}
+		default:
+			r.s.c.reset(r.s, errStreamClosed)
+			return nil
+		}
+	}
+}
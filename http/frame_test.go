@@ -0,0 +1,197 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// testName returns a shared memory name unique to the
+// test t.
+func testName(t testing.TB) string {
+	return fmt.Sprintf("/shm-go-http-test-%s-%d", strings.Replace(t.Name(), "/", "-", -1), os.Getpid())
+}
+
+// createPair creates a duplex shared memory and opens
+// its other end.
+func createPair(t *testing.T) (server, client *shm.ReadWriteCloser) {
+	name := testName(t)
+
+	server, err := shm.CreateDuplex(name, 0600, 64, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = shm.OpenDuplex(name)
+	server.Unlink()
+
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+// TestReadLoopViolation checks that a stream whose
+// frames break the protocol is reset, rather than
+// panicking the reading goroutine.
+func TestReadLoopViolation(t *testing.T) {
+	req, err := http.NewRequest("POST", "shm://server/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := appendRequestHead(nil, req)
+
+	for _, tc := range []struct {
+		name   string
+		frames func(c *conn)
+	}{
+		{"end twice", func(c *conn) {
+			c.writeHead(1, head, false)
+			c.writeFrame(1, frameData, flagEnd, 0, nil)
+			c.writeFrame(1, frameData, flagEnd, 0, nil)
+		}},
+		{"data after end", func(c *conn) {
+			c.writeHead(1, head, true)
+			c.writeFrame(1, frameData, 0, 0, []byte("late"))
+		}},
+		{"head twice", func(c *conn) {
+			c.writeHead(1, head, false)
+			c.writeHead(1, head, false)
+		}},
+		{"credit beyond window", func(c *conn) {
+			c.writeHead(1, head, false)
+			c.writeFrame(1, frameWindow, 0, 1, nil)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srw, crw := createPair(t)
+			defer crw.Close()
+			defer srw.Close()
+
+			streams := make(chan *stream, 2)
+			sc := newConn(srw, true, func(s *stream, head []byte, end bool) {
+				streams <- s
+			})
+
+			go sc.readLoop()
+			defer sc.close()
+
+			tc.frames(newConn(crw, false, nil))
+
+			var s *stream
+			select {
+			case s = <-streams:
+			case <-time.After(10 * time.Second):
+				t.Fatal("no stream was accepted")
+			}
+
+			select {
+			case <-s.done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("stream was not reset")
+			}
+
+			if s.err != errProtocol {
+				t.Fatalf("stream finished with %v, expected %v", s.err, errProtocol)
+			}
+
+			expectReset(t, crw, 1)
+		})
+	}
+}
+
+// expectReset skips past the frames read from rw until
+// a frameReset for the stream id.
+func expectReset(t *testing.T, rw *shm.ReadWriteCloser, id uint32) {
+	t.Helper()
+
+	for {
+		buf, err := rw.GetReadBufferDeadline(time.Now().Add(10 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		typ := buf.Flags[frameTypeIndex]
+		bufID := binary.LittleEndian.Uint32(buf.Flags[frameIDIndex:])
+
+		if err = rw.SendReadBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if typ == frameReset && bufID == id {
+			return
+		}
+	}
+}
+
+// TestReadLoopHeadLimit checks that a head spanning more
+// than maxHeadBytes resets its stream.
+func TestReadLoopHeadLimit(t *testing.T) {
+	srw, crw := createPair(t)
+	defer crw.Close()
+	defer srw.Close()
+
+	sc := newConn(srw, true, func(s *stream, head []byte, end bool) {
+		t.Error("oversized head was accepted")
+	})
+
+	go sc.readLoop()
+	defer sc.close()
+
+	cc := newConn(crw, false, nil)
+
+	part := make([]byte, sc.blockSize)
+	for n := 0; n <= maxHeadBytes; n += len(part) {
+		if err := cc.writeFrame(1, frameHead, flagMore, 0, part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectReset(t, crw, 1)
+}
+
+// TestTransportClose checks that Close stops the
+// Transport's reading goroutine and fails later
+// requests.
+func TestTransportClose(t *testing.T) {
+	srw, crw := createPair(t)
+	defer srw.Close()
+	defer crw.Close()
+
+	tr := NewTransport(crw)
+
+	closed := make(chan error, 1)
+	go func() { closed <- tr.Close() }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	req, err := http.NewRequest("GET", "shm://server/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.RoundTrip(req); err != errTransportClosed {
+		t.Fatalf("RoundTrip returned %v, expected %v", err, errTransportClosed)
+	}
+}
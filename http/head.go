@@ -0,0 +1,154 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"encoding/binary"
+	"net/http"
+)
+
+// Heads are encoded as a sequence of varints and
+// length-prefixed strings, rather than as HTTP/1.1 text.
+//
+// A request head holds the method, request URI, host,
+// content length and header. A response head holds the
+// status code and header. A header is held as the
+// number of values followed by each key and value.
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendHeader(b []byte, h http.Header) []byte {
+	var n int
+	for _, vv := range h {
+		n += len(vv)
+	}
+
+	b = appendUvarint(b, uint64(n))
+
+	for k, vv := range h {
+		for _, v := range vv {
+			b = appendString(appendString(b, k), v)
+		}
+	}
+
+	return b
+}
+
+type headReader struct {
+	b   []byte
+	err error
+}
+
+func (r *headReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.b, r.err = nil, errInvalidHead
+		return 0
+	}
+
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *headReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.b, r.err = nil, errInvalidHead
+		return 0
+	}
+
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *headReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.b, r.err = nil, errInvalidHead
+		return ""
+	}
+
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *headReader) header() http.Header {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.b, r.err = nil, errInvalidHead
+		return nil
+	}
+
+	h := make(http.Header, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		k := r.string()
+		h[k] = append(h[k], r.string())
+	}
+
+	return h
+}
+
+func appendRequestHead(b []byte, req *http.Request) []byte {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	contentLength := req.ContentLength
+	if contentLength == 0 && req.Body != nil && req.Body != http.NoBody {
+		contentLength = -1
+	}
+
+	b = appendString(b, req.Method)
+	b = appendString(b, req.URL.RequestURI())
+	b = appendString(b, host)
+	b = appendVarint(b, contentLength)
+	return appendHeader(b, req.Header)
+}
+
+func readRequestHead(head []byte) (method, requestURI, host string, contentLength int64, header http.Header, err error) {
+	r := &headReader{b: head}
+
+	method = r.string()
+	requestURI = r.string()
+	host = r.string()
+	contentLength = r.varint()
+	header = r.header()
+	return method, requestURI, host, contentLength, header, r.err
+}
+
+func appendResponseHead(b []byte, code int, header http.Header) []byte {
+	b = appendUvarint(b, uint64(code))
+	return appendHeader(b, header)
+}
+
+// readResponseHead reads a response head, whose status
+// code must have three digits, as net/http requires.
+func readResponseHead(head []byte) (code int, header http.Header, err error) {
+	r := &headReader{b: head}
+
+	status := r.uvarint()
+	header = r.header()
+
+	if r.err == nil && (status < 100 || status > 999) {
+		return 0, nil, errInvalidHead
+	}
+
+	return int(status), header, r.err
+}
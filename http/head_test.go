@@ -0,0 +1,37 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReadResponseHead(t *testing.T) {
+	header := http.Header{"Content-Type": {"text/plain"}}
+
+	for _, tc := range []struct {
+		code int
+		err  error
+	}{
+		{100, nil},
+		{200, nil},
+		{999, nil},
+		{0, errInvalidHead},
+		{99, errInvalidHead},
+		{1000, errInvalidHead},
+	} {
+		code, h, err := readResponseHead(appendResponseHead(nil, tc.code, header))
+		if err != tc.err {
+			t.Errorf("status %d: got error %v, expected %v", tc.code, err, tc.err)
+			continue
+		}
+
+		if err == nil && (code != tc.code || h.Get("Content-Type") != "text/plain") {
+			t.Errorf("status %d: got %d %v", tc.code, code, h)
+		}
+	}
+}
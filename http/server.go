@@ -0,0 +1,253 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// Server serves requests sent by a Transport over a
+// duplex shared memory. Each request is handled in its
+// own goroutine.
+type Server struct {
+	// Handler handles each request, http.DefaultServeMux
+	// is used if it is nil.
+	Handler http.Handler
+
+	// ErrorLog logs handlers that panic, the log
+	// package's standard logger is used if it is nil.
+	ErrorLog *log.Logger
+
+	mu     sync.Mutex
+	conns  map[*conn]struct{}
+	closed bool
+}
+
+// Serve serves requests sent over rw with handler.
+func Serve(rw *shm.ReadWriteCloser, handler http.Handler) error {
+	return (&Server{Handler: handler}).Serve(rw)
+}
+
+// Serve serves requests sent over rw until reading from
+// it fails or Close is called, when it returns
+// http.ErrServerClosed. It takes every block read from
+// rw, so rw must not otherwise be read from.
+func (srv *Server) Serve(rw *shm.ReadWriteCloser) error {
+	var c *conn
+	c = newConn(rw, true, func(s *stream, head []byte, end bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		c.mut.Lock()
+		s.cancel = cancel
+		c.mut.Unlock()
+
+		go srv.handle(ctx, s, head, end)
+	})
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return http.ErrServerClosed
+	}
+
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]struct{})
+	}
+
+	srv.conns[c] = struct{}{}
+	srv.mu.Unlock()
+
+	err := c.readLoop()
+
+	srv.mu.Lock()
+	delete(srv.conns, c)
+	closed := srv.closed
+	srv.mu.Unlock()
+
+	if closed && err == errTransportClosed {
+		return http.ErrServerClosed
+	}
+
+	return err
+}
+
+// Close stops every call to Serve and fails the requests
+// they are serving. As with Transport.Close, it waits for
+// each to stop reading, but it neither closes the shared
+// memory nor waits for handlers to return.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+
+	srv.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+
+	return nil
+}
+
+func (srv *Server) handle(ctx context.Context, s *stream, head []byte, end bool) {
+	method, requestURI, host, contentLength, header, err := readRequestHead(head)
+
+	var u *url.URL
+	if err == nil {
+		u, err = url.ParseRequestURI(requestURI)
+	}
+
+	if err != nil {
+		s.c.reset(s, err)
+		return
+	}
+
+	req := (&http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       host,
+		RemoteAddr: s.c.rw.Name(),
+		RequestURI: requestURI,
+
+		ContentLength: contentLength,
+	}).WithContext(ctx)
+
+	var body *bodyReader
+	if !end {
+		body = &bodyReader{s: s}
+		req.Body = body
+	}
+
+	w := &responseWriter{
+		s:      s,
+		header: make(http.Header),
+		head:   req.Method == "HEAD",
+	}
+	w.w = bufio.NewWriterSize(&w.body, s.c.blockSize)
+	w.body.s = s
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.c.reset(s, errStreamClosed)
+
+			if v != http.ErrAbortHandler {
+				srv.logf("shm/http: panic serving %s: %v", req.URL, v)
+			}
+
+			return
+		}
+
+		if err := w.finish(); err != nil {
+			s.c.reset(s, err)
+			return
+		}
+
+		// A body that was not read to the end resets the
+		// stream, so that the Transport stops sending it.
+		if body != nil {
+			body.Close()
+		}
+	}()
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	handler.ServeHTTP(w, req)
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// responseWriter implements http.ResponseWriter and
+// http.Flusher. Writes are buffered up to a block, and
+// the head is sent ahead of the first block.
+type responseWriter struct {
+	s *stream
+
+	header http.Header
+	status int
+
+	// head is set for HEAD requests, whose body is
+	// discarded.
+	head bool
+
+	body bodyWriter
+	w    *bufio.Writer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+
+	w.status = code
+	w.body.head = appendResponseHead(nil, code, w.header)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		if w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.head {
+		return len(p), nil
+	}
+
+	return w.w.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.w.Flush() == nil {
+		w.body.flushHead()
+	}
+}
+
+func (w *responseWriter) finish() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	return w.body.end()
+}
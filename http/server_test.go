@@ -0,0 +1,230 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves handler over a duplex shared memory
+// and returns a Transport that sends requests to it.
+func startServer(t *testing.T, handler http.Handler) (*Server, *Transport) {
+	srw, crw := createPair(t)
+
+	srv := &Server{Handler: handler}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(srw) }()
+
+	tr := NewTransport(crw)
+
+	t.Cleanup(func() {
+		tr.Close()
+		srv.Close()
+
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("Serve returned %v, expected %v", err, http.ErrServerClosed)
+		}
+
+		crw.Close()
+		srw.Close()
+	})
+
+	return srv, tr
+}
+
+// echo replies with the request path followed by the
+// request body.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.URL.Path)
+	io.Copy(w, r.Body)
+})
+
+func TestRoundTrip(t *testing.T) {
+	_, tr := startServer(t, echo)
+
+	const requests = 16
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path, body := fmt.Sprintf("/%d", i), fmt.Sprintf("body %d", i)
+
+			req, err := http.NewRequest("POST", "shm://server"+path, strings.NewReader(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			got, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if err != nil {
+				errs <- err
+			} else if resp.StatusCode != http.StatusOK || string(got) != path+body {
+				errs <- fmt.Errorf("request %d: got %d %q, expected %d %q",
+					i, resp.StatusCode, got, http.StatusOK, path+body)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestRoundTripLargeBody checks that bodies spanning many
+// blocks, and many times the stream window, arrive
+// intact in both directions.
+func TestRoundTripLargeBody(t *testing.T) {
+	_, tr := startServer(t, echo)
+
+	body := make([]byte, 64*1024+17)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	req, err := http.NewRequest("PUT", "shm://server/large", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, append([]byte("/large"), body...)) {
+		t.Fatalf("response body of %d bytes does not match request body of %d bytes", len(got), len(body))
+	}
+}
+
+// TestRoundTripStreamed checks that a flushed response
+// reaches the client while the handler is still running.
+func TestRoundTripStreamed(t *testing.T) {
+	proceed := make(chan struct{})
+
+	_, tr := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-proceed:
+		case <-r.Context().Done():
+			return
+		}
+
+		io.WriteString(w, "second")
+	}))
+
+	req, err := http.NewRequest("GET", "shm://server/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	first := make([]byte, len("first"))
+	if _, err = io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first) != "first" {
+		t.Fatalf("read %q, expected %q", first, "first")
+	}
+
+	close(proceed)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "second" {
+		t.Fatalf("read %q, expected %q", rest, "second")
+	}
+}
+
+// TestServerClose checks that Close stops Serve and
+// cancels the requests being handled.
+func TestServerClose(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	srv, tr := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "shm://server/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go tr.RoundTrip(req.WithContext(ctx))
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request was not handled")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- srv.Close() }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request context was not cancelled")
+	}
+}
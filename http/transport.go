@@ -0,0 +1,174 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// Transport is an http.RoundTripper that sends requests
+// to a Server over a duplex shared memory. Any number of
+// requests may be in flight at once.
+//
+// The URL's scheme and host are ignored, every request
+// goes to the shared memory the Transport was created
+// with. It may be registered with an http.Transport:
+//
+//	t := &http.Transport{}
+//	t.RegisterProtocol("shm", shmhttp.NewTransport(rw))
+//	c := &http.Client{Transport: t}
+//	resp, err := c.Get("shm://server/path")
+//
+// The Transport takes every block read from rw, so rw
+// must not otherwise be read from. Close stops it.
+type Transport struct {
+	c *conn
+
+	nextID uint32
+}
+
+// NewTransport returns a Transport that sends requests
+// over rw.
+func NewTransport(rw *shm.ReadWriteCloser) *Transport {
+	t := &Transport{
+		c: newConn(rw, false, func(s *stream, head []byte, end bool) {
+			select {
+			case s.heads <- head:
+			default:
+			}
+		}),
+	}
+
+	go t.c.readLoop()
+	return t
+}
+
+// Close stops the Transport from reading from rw and
+// fails any request in flight. It waits for the reading
+// goroutine to return, but does not close rw, which may
+// be closed once every response body has been closed.
+func (t *Transport) Close() error {
+	t.c.close()
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+
+	s, err := t.c.add(atomic.AddUint32(&t.nextID, 1))
+	if err != nil {
+		if hasBody {
+			req.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	if err = t.c.writeHead(s.id, appendRequestHead(nil, req), !hasBody); err != nil {
+		if hasBody {
+			req.Body.Close()
+		}
+
+		t.c.reset(s, err)
+		return nil, err
+	}
+
+	if hasBody {
+		go t.upload(s, req.Body)
+	} else {
+		t.c.ended(s, true)
+	}
+
+	ctx := req.Context()
+
+	var head []byte
+	select {
+	case head = <-s.heads:
+	case <-s.done:
+		// The response may have ended the stream as soon
+		// as it arrived.
+		select {
+		case head = <-s.heads:
+		default:
+			if s.err != nil {
+				return nil, s.err
+			}
+
+			return nil, errStreamClosed
+		}
+	case <-ctx.Done():
+		t.c.reset(s, ctx.Err())
+		return nil, ctx.Err()
+	}
+
+	code, header, err := readResponseHead(head)
+	if err != nil {
+		t.c.reset(s, err)
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       &bodyReader{s: s},
+		Request:    req,
+
+		ContentLength: -1,
+	}
+
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+
+	if req.Method == "HEAD" {
+		resp.Body = http.NoBody
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.c.reset(s, ctx.Err())
+			case <-s.done:
+			}
+		}()
+	}
+
+	return resp, nil
+}
+
+// upload sends the request body.
+func (t *Transport) upload(s *stream, body io.ReadCloser) {
+	bw := &bodyWriter{s: s}
+	w := bufio.NewWriterSize(bw, t.c.blockSize)
+
+	_, err := io.Copy(w, body)
+	body.Close()
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = bw.end()
+	}
+
+	if err != nil {
+		t.c.reset(s, err)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Mailbox is a single shared value that holds the most
+// recent snapshot stored by a writer. Readers never
+// block a writer, and always load a consistent copy of
+// the latest snapshot.
+//
+// The snapshot is guarded by a seqlock held in the
+// sequence number of a ring of one block. Store makes
+// the sequence number odd while it copies the
+// snapshot in, and Load retries until it sees the same
+// even sequence number either side of its copy.
+//
+// The writer holding the seqlock is recorded as the
+// owner of the block. If it exits while storing a
+// snapshot, the next Store takes over the seqlock and
+// Load returns ErrSnapshotAbandoned until it does. As
+// with (*ReadWriteCloser).Recover, owners are judged by
+// process ID, so the processes sharing a mailbox must
+// share a PID namespace.
+type Mailbox struct {
+	name string
+
+	seg    *segment
+	shared *sharedMem
+	block  *sharedBlock
+	data   []byte
+
+	timestamps bool
+
+	// Must be accessed using atomic operations
+	Flags *[sharedFlagsSize]uint32
+
+	closed uint32
+}
+
+// CreateMailbox creates a mailbox that holds snapshots
+// of up to size bytes. size is rounded up to a
+// multiple of 64, it must not be negative.
+func CreateMailbox(name string, perm os.FileMode, size int) (*Mailbox, error) {
+	return CreateMailboxWithOptions(name, perm, size, nil)
+}
+
+// CreateMailboxWithOptions is like CreateMailbox but
+// accepts a set of optional parameters. opts may be
+// nil. Only Metadata and Timestamps apply to a
+// mailbox.
+func CreateMailboxWithOptions(name string, perm os.FileMode, size int, opts *CreateOptions) (*Mailbox, error) {
+	var (
+		metadata []byte
+		features uint32
+	)
+
+	if opts != nil {
+		metadata = opts.Metadata
+
+		if opts.Timestamps {
+			features |= featureTimestamps
+		}
+	}
+
+	if size < 0 {
+		return nil, ErrInvalidSharedMemory
+	}
+
+	g := geometry{1, (uint64(size) + 0x3f) &^ 0x3f}
+
+	seg, err := createSegment(name, 0, perm, [2]geometry{g, g}, sharedHeaderSize, nil, metadata, features, incompatMailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMailbox(name, seg), nil
+}
+
+// OpenMailbox opens the named mailbox.
+func OpenMailbox(name string) (*Mailbox, error) {
+	seg, err := openSegment(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if seg.incompat&incompatMailbox == 0 || uint32(seg.rings[0].shared.BlockCount) != 1 {
+		unix.Munmap(seg.data)
+		return nil, ErrNotMailbox
+	}
+
+	return newMailbox(name, seg), nil
+}
+
+// ownerCheckInterval is the number of times Store and
+// Load retry while the seqlock is held before checking
+// that its owner is still alive.
+const ownerCheckInterval = 1 << 10
+
+func newMailbox(name string, seg *segment) *Mailbox {
+	r := &seg.rings[0]
+	shared := r.shared
+
+	block := (*sharedBlock)(unsafe.Pointer(uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)))
+	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+
+	return &Mailbox{
+		name: name,
+
+		seg:    seg,
+		shared: shared,
+		block:  block,
+		data:   data[:shared.BlockSize:shared.BlockSize],
+
+		timestamps: seg.features&featureTimestamps != 0,
+
+		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
+	}
+}
+
+func (m *Mailbox) Close() error {
+	if !atomic.CompareAndSwapUint32(&m.closed, 0, 1) {
+		return nil
+	}
+
+	return unix.Munmap(m.seg.data)
+}
+
+// Name returns the name of the shared memory.
+func (m *Mailbox) Name() string {
+	return m.name
+}
+
+// Metadata returns a copy of the application-defined
+// metadata that was passed in CreateOptions when the
+// mailbox was created.
+//
+// It returns nil if no metadata was set.
+func (m *Mailbox) Metadata() []byte {
+	if len(m.seg.metadata) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), m.seg.metadata...)
+}
+
+// Unlink removes the shared memory.
+//
+// It is the equivalent to calling Unlink(string) with
+// the same name as CreateMailbox or OpenMailbox.
+func (m *Mailbox) Unlink() error {
+	return Unlink(m.name)
+}
+
+// Cap returns the largest snapshot the mailbox can
+// hold.
+func (m *Mailbox) Cap() int {
+	return len(m.data)
+}
+
+// Seq returns the sequence number of the latest
+// snapshot. It changes each time Store is called, and
+// may be compared with an earlier value to see whether
+// a new snapshot has been stored.
+func (m *Mailbox) Seq() uint32 {
+	return atomic.LoadUint32((*uint32)(&m.block.Seq)) &^ 1
+}
+
+// Store replaces the snapshot with a copy of p. It
+// returns ErrSnapshotTooLarge if p is larger than Cap.
+//
+// Concurrent calls to Store, from any process, are
+// serialised.
+func (m *Mailbox) Store(p []byte) error {
+	if atomic.LoadUint32(&m.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if len(p) > len(m.data) {
+		return ErrSnapshotTooLarge
+	}
+
+	seqPtr := (*uint32)(&m.block.Seq)
+	ownerPtr := (*uint32)(&m.block.Owner)
+
+	// held is the odd sequence number of the seqlock
+	// once it is held by this process.
+	var held uint32
+
+	for spins := 1; ; spins++ {
+		seq := atomic.LoadUint32(seqPtr)
+		if seq&1 == 0 && atomic.CompareAndSwapUint32(seqPtr, seq, seq+1) {
+			held = seq + 1
+			atomic.StoreUint32(ownerPtr, ownerPID)
+			break
+		}
+
+		// Another writer is storing a snapshot. If it
+		// has exited, take the seqlock over from it.
+		if seq&1 != 0 && spins%ownerCheckInterval == 0 {
+			if owner, dead := m.abandoned(); dead &&
+				atomic.CompareAndSwapUint32(ownerPtr, owner, ownerPID) {
+				held = seq
+				break
+			}
+		}
+
+		runtime.Gosched()
+	}
+
+	copy(m.data, p)
+	atomic.StoreUint64((*uint64)(&m.block.Size), uint64(len(p)))
+
+	if m.timestamps {
+		atomic.StoreUint64((*uint64)(&m.block.PublishedAt), uint64(Monotonic()))
+	}
+
+	atomic.StoreUint32(ownerPtr, 0)
+	atomic.StoreUint32(seqPtr, held+1)
+
+	atomic.AddUint64((*uint64)(&m.shared.BlocksSent), 1)
+	atomic.AddUint64((*uint64)(&m.shared.BytesSent), uint64(len(p)))
+	return nil
+}
+
+// abandoned returns the owner of the seqlock and
+// reports whether it has exited. A writer that exited
+// before recording itself as the owner cannot be
+// detected.
+func (m *Mailbox) abandoned() (owner uint32, dead bool) {
+	owner = atomic.LoadUint32((*uint32)(&m.block.Owner))
+	return owner, owner != 0 && !processAlive(owner)
+}
+
+// Load copies the latest snapshot into p and returns
+// its size. It returns io.ErrShortBuffer, and the size
+// of the snapshot, if p is too small to hold it.
+//
+// Load never waits for a writer, but retries its copy
+// if a snapshot is stored while it is being read. It
+// returns ErrSnapshotAbandoned if a writer exited while
+// storing the snapshot.
+func (m *Mailbox) Load(p []byte) (n int, err error) {
+	n, _, err = m.LoadWithTime(p)
+	return n, err
+}
+
+// LoadWithTime is like Load but also returns the
+// CLOCK_MONOTONIC time, in nanoseconds, at which the
+// snapshot was stored. The time is only set when the
+// mailbox was created with CreateOptions.Timestamps.
+func (m *Mailbox) LoadWithTime(p []byte) (n int, publishedAt int64, err error) {
+	if atomic.LoadUint32(&m.closed) != 0 {
+		return 0, 0, io.ErrClosedPipe
+	}
+
+	seqPtr := (*uint32)(&m.block.Seq)
+
+	for spins := 1; ; spins++ {
+		seq := atomic.LoadUint32(seqPtr)
+		if seq&1 != 0 {
+			// A writer is storing a snapshot.
+			if spins%ownerCheckInterval == 0 {
+				if _, dead := m.abandoned(); dead && atomic.LoadUint32(seqPtr) == seq {
+					return 0, 0, ErrSnapshotAbandoned
+				}
+			}
+
+			runtime.Gosched()
+			continue
+		}
+
+		size := atomic.LoadUint64((*uint64)(&m.block.Size))
+		if size > uint64(len(m.data)) {
+			size = uint64(len(m.data))
+		}
+
+		publishedAt = int64(atomic.LoadUint64((*uint64)(&m.block.PublishedAt)))
+
+		if size > uint64(len(p)) {
+			err = io.ErrShortBuffer
+		} else {
+			copy(p, m.data[:size])
+			err = nil
+		}
+
+		if atomic.LoadUint32(seqPtr) == seq {
+			return int(size), publishedAt, err
+		}
+	}
+}
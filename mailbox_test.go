@@ -0,0 +1,173 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMailbox checks that Load returns the snapshot
+// last stored by any process.
+func TestMailbox(t *testing.T) {
+	name := testName(t)
+
+	m, err := CreateMailbox(name, 0600, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	defer m.Unlink()
+
+	if m.Cap() != 128 {
+		t.Errorf("Cap returned %d, expected 128", m.Cap())
+	}
+
+	peer, err := OpenMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	p := make([]byte, 128)
+	if n, err := peer.Load(p); n != 0 || err != nil {
+		t.Fatalf("Load of an empty mailbox returned %d, %v", n, err)
+	}
+
+	seq := peer.Seq()
+
+	if err := m.Store([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Seq() == seq {
+		t.Error("Seq did not change after Store")
+	}
+
+	if n, err := peer.Load(p); err != nil || string(p[:n]) != "hello" {
+		t.Fatalf("Load returned %q, %v, expected %q", p[:n], err, "hello")
+	}
+
+	if n, err := peer.Load(p[:2]); err != io.ErrShortBuffer || n != 5 {
+		t.Errorf("Load into a short buffer returned %d, %v, expected 5, %v", n, err, io.ErrShortBuffer)
+	}
+
+	if err := peer.Store(make([]byte, 129)); err != ErrSnapshotTooLarge {
+		t.Errorf("Store returned %v, expected %v", err, ErrSnapshotTooLarge)
+	}
+}
+
+// TestMailboxInvalidSize checks that a negative size is
+// rejected rather than wrapped around.
+func TestMailboxInvalidSize(t *testing.T) {
+	if m, err := CreateMailbox(testName(t), 0600, -1); err == nil {
+		m.Unlink()
+		m.Close()
+		t.Fatal("CreateMailbox succeeded")
+	}
+}
+
+// TestMailboxConsistent checks that Load never returns
+// a snapshot that is torn by a concurrent Store.
+func TestMailboxConsistent(t *testing.T) {
+	name := testName(t)
+
+	m, err := CreateMailbox(name, 0600, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	defer m.Unlink()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// Every snapshot is filled with a single byte.
+			p := make([]byte, 4096)
+			for i := w; ; i += 2 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for j := range p {
+					p[j] = byte(i)
+				}
+
+				if err := m.Store(p[:1+i%len(p)]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	p := make([]byte, 4096)
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+		n, err := m.Load(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n > 0 && bytes.Count(p[:n], p[:1]) != n {
+			t.Fatal("Load returned a torn snapshot")
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// TestMailboxAbandoned checks that a snapshot abandoned
+// by a writer that exited mid-Store is reported by Load
+// and taken over by the next Store.
+func TestMailboxAbandoned(t *testing.T) {
+	name := testName(t)
+
+	m, err := CreateMailbox(name, 0600, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	defer m.Unlink()
+
+	if err := m.Store([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := startHelper(t, "mailbox-hold", name)
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	p := make([]byte, 64)
+	if _, err := m.Load(p); err != ErrSnapshotAbandoned {
+		t.Fatalf("Load returned %v, expected %v", err, ErrSnapshotAbandoned)
+	}
+
+	if err := m.Store([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := m.Load(p); err != nil || string(p[:n]) != "after" {
+		t.Fatalf("Load returned %q, %v, expected %q", p[:n], err, "after")
+	}
+
+	if seq := m.Seq(); seq&1 != 0 {
+		t.Errorf("Seq returned odd %d after takeover", seq)
+	}
+}
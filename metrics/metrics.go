@@ -0,0 +1,362 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Package metrics exports the statistics of shm-go
+// shared memory.
+//
+// Registered shared memory is published through expvar
+// under the "shm" key. Registry.ServeHTTP serves the
+// Prometheus text format and Registry.Collect yields
+// each metric in a form that maps directly onto the
+// prometheus client library without depending on it:
+//
+// 	func (c collector) Collect(ch chan<- prometheus.Metric) {
+// 		metrics.DefaultRegistry.Collect(func(m metrics.Metric) {
+// 			desc := prometheus.NewDesc(m.Name, m.Help, metrics.LabelNames, nil)
+// 			switch m.Kind {
+// 			case metrics.Counter:
+// 				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, m.Value, m.LabelValues[:]...)
+// 			case metrics.Gauge:
+// 				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Value, m.LabelValues[:]...)
+// 			case metrics.Histogram:
+// 				ch <- prometheus.MustNewConstHistogram(desc, m.Count, m.Sum, m.Buckets, m.LabelValues[:]...)
+// 			}
+// 		})
+// 	}
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// Source is a shared memory that can report its
+// statistics. It is implemented by *shm.ReadWriteCloser
+// and *shm.Observer.
+type Source interface {
+	Name() string
+	Stats() shm.Stats
+}
+
+// Kind is the type of a Metric.
+type Kind int
+
+const (
+	Counter Kind = iota
+	Gauge
+	Histogram
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Histogram:
+		return "histogram"
+	default:
+		return "untyped"
+	}
+}
+
+// LabelNames are the names of the labels attached to
+// every Metric.
+var LabelNames = []string{"name", "direction"}
+
+// Metric is a single sample of a metric.
+type Metric struct {
+	Name string
+	Help string
+	Kind Kind
+
+	// LabelValues holds the values of the labels named
+	// by LabelNames. direction is read or write for
+	// duplex shared memory and simplex otherwise.
+	LabelValues [2]string
+
+	// Value is set for counters and gauges.
+	Value float64
+
+	// Count, Sum and Buckets are set for histograms.
+	// Buckets maps the inclusive upper bound of each
+	// bucket, in seconds, to the cumulative count.
+	Count   uint64
+	Sum     float64
+	Buckets map[float64]uint64
+}
+
+type desc struct {
+	name, help string
+	kind       Kind
+
+	value     func(s *shm.RingStats) uint64
+	histogram func(s *shm.RingStats) *shm.WaitHistogram
+}
+
+var descs = []desc{
+	{name: "shm_blocks", help: "Number of blocks in the ring.", kind: Gauge,
+		value: func(s *shm.RingStats) uint64 { return uint64(s.BlockCount) }},
+	{name: "shm_block_size_bytes", help: "Size of each block in the ring.", kind: Gauge,
+		value: func(s *shm.RingStats) uint64 { return uint64(s.BlockSize) }},
+	{name: "shm_readable_blocks", help: "Number of blocks sent but not yet taken by a reader.", kind: Gauge,
+		value: func(s *shm.RingStats) uint64 { return uint64(s.Readable) }},
+	{name: "shm_writable_blocks", help: "Number of blocks free to be taken by a writer.", kind: Gauge,
+		value: func(s *shm.RingStats) uint64 { return uint64(s.Writable) }},
+	{name: "shm_in_flight_blocks", help: "Number of blocks taken by a reader or writer but not yet sent.", kind: Gauge,
+		value: func(s *shm.RingStats) uint64 { return uint64(s.InFlight) }},
+	{name: "shm_sent_blocks_total", help: "Total number of blocks sent to the ring.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.BlocksSent }},
+	{name: "shm_sent_bytes_total", help: "Total number of bytes sent to the ring.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.BytesSent }},
+	{name: "shm_received_blocks_total", help: "Total number of blocks received from the ring.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.BlocksReceived }},
+	{name: "shm_received_bytes_total", help: "Total number of bytes received from the ring.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.BytesReceived }},
+	{name: "shm_overwritten_blocks_total", help: "Total number of blocks overwritten before they were read.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.Overwritten }},
+	{name: "shm_aborted_blocks_total", help: "Total number of blocks taken by a writer but never sent.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.Aborted }},
+	{name: "shm_read_waits_total", help: "Total number of times a reader blocked on a semaphore.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.ReadWaits }},
+	{name: "shm_write_waits_total", help: "Total number of times a writer blocked on a semaphore.", kind: Counter,
+		value: func(s *shm.RingStats) uint64 { return s.WriteWaits }},
+	{name: "shm_read_wait_seconds", help: "Time readers spent blocked on a semaphore.", kind: Histogram,
+		histogram: func(s *shm.RingStats) *shm.WaitHistogram { return &s.ReadWaitTime }},
+	{name: "shm_write_wait_seconds", help: "Time writers spent blocked on a semaphore.", kind: Histogram,
+		histogram: func(s *shm.RingStats) *shm.WaitHistogram { return &s.WriteWaitTime }},
+}
+
+// Registry is a set of shared memory to export
+// metrics for.
+type Registry struct {
+	mu      sync.RWMutex
+	sources map[string]Source
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		sources: make(map[string]Source),
+	}
+}
+
+// DefaultRegistry is published through expvar as "shm".
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	expvar.Publish("shm", DefaultRegistry)
+}
+
+// Register adds src to the DefaultRegistry.
+func Register(src Source) error {
+	return DefaultRegistry.Register(src)
+}
+
+// Unregister removes src from the DefaultRegistry.
+func Unregister(src Source) {
+	DefaultRegistry.Unregister(src)
+}
+
+// Register adds src to the Registry. It returns an
+// error if shared memory with the same name is already
+// registered.
+func (r *Registry) Register(src Source) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, dup := r.sources[src.Name()]; dup {
+		return errors.New("metrics: " + src.Name() + " is already registered")
+	}
+
+	r.sources[src.Name()] = src
+	return nil
+}
+
+// Unregister removes src from the Registry.
+func (r *Registry) Unregister(src Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sources[src.Name()] == src {
+		delete(r.sources, src.Name())
+	}
+}
+
+type snapshot struct {
+	name  string
+	stats shm.Stats
+}
+
+func (r *Registry) snapshot() []snapshot {
+	r.mu.RLock()
+	snaps := make([]snapshot, 0, len(r.sources))
+
+	for name, src := range r.sources {
+		snaps = append(snaps, snapshot{name, src.Stats()})
+	}
+
+	r.mu.RUnlock()
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].name < snaps[j].name
+	})
+	return snaps
+}
+
+// String implements expvar.Var. It returns the
+// statistics of each registered shared memory as a
+// JSON object keyed by name.
+func (r *Registry) String() string {
+	snaps := r.snapshot()
+
+	m := make(map[string]shm.Stats, len(snaps))
+	for _, snap := range snaps {
+		m[snap.name] = snap.stats
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "{}"
+	}
+
+	return string(b)
+}
+
+// Collect calls fn with every metric of every
+// registered shared memory, grouped by metric name.
+func (r *Registry) Collect(fn func(Metric)) {
+	snaps := r.snapshot()
+
+	for _, d := range descs {
+		for i := range snaps {
+			rings := []struct {
+				direction string
+				stats     *shm.RingStats
+			}{
+				{"read", &snaps[i].stats.Read},
+				{"write", &snaps[i].stats.Write},
+			}
+
+			if !snaps[i].stats.Duplex {
+				rings = rings[:1]
+				rings[0].direction = "simplex"
+			}
+
+			for _, ring := range rings {
+				m := Metric{
+					Name: d.name,
+					Help: d.help,
+					Kind: d.kind,
+
+					LabelValues: [2]string{snaps[i].name, ring.direction},
+				}
+
+				if d.kind == Histogram {
+					h := d.histogram(ring.stats)
+
+					m.Sum = h.Sum.Seconds()
+					m.Buckets = make(map[float64]uint64, len(shm.WaitHistogramBounds))
+
+					for j, bound := range shm.WaitHistogramBounds {
+						m.Count += h.Counts[j]
+						m.Buckets[bound.Seconds()] = m.Count
+					}
+
+					m.Count += h.Counts[len(h.Counts)-1]
+				} else {
+					m.Value = float64(d.value(ring.stats))
+				}
+
+				fn(m)
+			}
+		}
+	}
+}
+
+// ServeHTTP serves the metrics of every registered
+// shared memory in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// WriteText writes the metrics of every registered
+// shared memory to w in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	var (
+		last string
+		err  error
+	)
+
+	r.Collect(func(m Metric) {
+		if err != nil {
+			return
+		}
+
+		if m.Name != last {
+			last = m.Name
+
+			if _, err = fmt.Fprintf(w, "# HELP %[1]s %[2]s\n# TYPE %[1]s %[3]s\n", m.Name, m.Help, m.Kind); err != nil {
+				return
+			}
+		}
+
+		labels := formatLabels(m.LabelValues[:])
+
+		if m.Kind != Histogram {
+			_, err = fmt.Fprintf(w, "%s{%s} %s\n", m.Name, labels, formatFloat(m.Value))
+			return
+		}
+
+		bounds := make([]float64, 0, len(m.Buckets))
+		for bound := range m.Buckets {
+			bounds = append(bounds, bound)
+		}
+
+		sort.Float64s(bounds)
+
+		for _, bound := range bounds {
+			if _, err = fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", m.Name, labels, formatFloat(bound), m.Buckets[bound]); err != nil {
+				return
+			}
+		}
+
+		_, err = fmt.Fprintf(w, "%[1]s_bucket{%[2]s,le=\"+Inf\"} %[3]d\n%[1]s_sum{%[2]s} %[4]s\n%[1]s_count{%[2]s} %[3]d\n",
+			m.Name, labels, m.Count, formatFloat(m.Sum))
+	})
+
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(values []string) string {
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = LabelNames[i] + `="` + labelEscaper.Replace(value) + `"`
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// source is a Source with fixed statistics.
+type source struct {
+	name  string
+	stats shm.Stats
+}
+
+func (s *source) Name() string     { return s.name }
+func (s *source) Stats() shm.Stats { return s.stats }
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+
+	a := &source{name: "/a"}
+	if err := r.Register(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Register(&source{name: "/a"}); err == nil {
+		t.Error("Register succeeded for a duplicate name")
+	}
+
+	// Unregistering a different source with the same
+	// name leaves the registered one in place.
+	r.Unregister(&source{name: "/a"})
+	if r.String() != `{"/a":`+mustMarshal(t, a.stats)+`}` {
+		t.Errorf("String returned %s after unregistering another source", r.String())
+	}
+
+	r.Unregister(a)
+	if r.String() != "{}" {
+		t.Errorf("String returned %s, expected {}", r.String())
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestCollect(t *testing.T) {
+	r := NewRegistry()
+
+	r.Register(&source{name: "/simplex", stats: shm.Stats{
+		Read: shm.RingStats{BlockCount: 8, BlocksSent: 3},
+	}})
+	r.Register(&source{name: "/duplex", stats: shm.Stats{
+		Duplex: true,
+
+		Read:  shm.RingStats{BlockCount: 4, BlocksSent: 1},
+		Write: shm.RingStats{BlockCount: 4, BlocksSent: 2},
+	}})
+
+	got := make(map[string]float64)
+	r.Collect(func(m Metric) {
+		if m.Kind == Histogram {
+			return
+		}
+
+		got[m.Name+" "+strings.Join(m.LabelValues[:], " ")] = m.Value
+	})
+
+	for key, value := range map[string]float64{
+		"shm_blocks /simplex simplex":            8,
+		"shm_sent_blocks_total /simplex simplex": 3,
+		"shm_sent_blocks_total /duplex read":     1,
+		"shm_sent_blocks_total /duplex write":    2,
+	} {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("%s was %v, expected %v", key, v, value)
+		}
+	}
+
+	if _, ok := got["shm_blocks /simplex write"]; ok {
+		t.Error("simplex shared memory reported a write direction")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+
+	var rs shm.RingStats
+	rs.ReadWaitTime.Counts[0] = 1
+	rs.ReadWaitTime.Counts[2] = 2
+	rs.ReadWaitTime.Counts[len(rs.ReadWaitTime.Counts)-1] = 4
+	rs.ReadWaitTime.Sum = time.Second
+
+	r.Register(&source{name: "/ring", stats: shm.Stats{Read: rs}})
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE shm_read_wait_seconds histogram",
+		fmt.Sprintf(`shm_read_wait_seconds_bucket{name="/ring",direction="simplex",le="%s"} 1`, formatFloat(shm.WaitHistogramBounds[0].Seconds())),
+		fmt.Sprintf(`shm_read_wait_seconds_bucket{name="/ring",direction="simplex",le="%s"} 1`, formatFloat(shm.WaitHistogramBounds[1].Seconds())),
+		fmt.Sprintf(`shm_read_wait_seconds_bucket{name="/ring",direction="simplex",le="%s"} 3`, formatFloat(shm.WaitHistogramBounds[2].Seconds())),
+		`shm_read_wait_seconds_bucket{name="/ring",direction="simplex",le="+Inf"} 7`,
+		`shm_read_wait_seconds_sum{name="/ring",direction="simplex"} 1`,
+		`shm_read_wait_seconds_count{name="/ring",direction="simplex"} 7`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("WriteText did not write %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	if got, expect := formatLabels([]string{"a\"b\\c\nd", "read"}), `name="a\"b\\c\nd",direction="read"`; got != expect {
+		t.Errorf("formatLabels returned %s, expected %s", got, expect)
+	}
+}
+
+// TestServeHTTP checks the counters of shared memory in
+// use are served in the Prometheus text format.
+func TestServeHTTP(t *testing.T) {
+	name := fmt.Sprintf("/shm-go-metrics-test-%d", os.Getpid())
+
+	rw, err := shm.CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if _, err := rw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry()
+	if err := r.Register(rw); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type was %q", ct)
+	}
+
+	for _, line := range []string{
+		"# HELP shm_sent_blocks_total Total number of blocks sent to the ring.",
+		"# TYPE shm_sent_blocks_total counter",
+		fmt.Sprintf(`shm_sent_blocks_total{name=%q,direction="simplex"} 1`, name),
+		fmt.Sprintf(`shm_sent_bytes_total{name=%q,direction="simplex"} 5`, name),
+		fmt.Sprintf(`shm_readable_blocks{name=%q,direction="simplex"} 1`, name),
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("ServeHTTP did not write %q:\n%s", line, rec.Body.String())
+		}
+	}
+}
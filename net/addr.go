@@ -5,6 +5,20 @@
 
 package net
 
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBlockCount = 1024
+	defaultBlockSize  = 8192
+	defaultPerm       = 0600
+)
+
 type addr string
 
 func (addr) Network() string {
@@ -14,3 +28,88 @@ func (addr) Network() string {
 func (a addr) String() string {
 	return string(a)
 }
+
+// addrOptions is a parsed address. An address is either
+// the name of a shared memory, such as "/name", or a
+// URL of the form
+//
+//	shm:///name?blocks=1024&size=8192&perm=0600
+//
+// "shm://name" is the same as "shm:///name". The blocks,
+// size and perm options give the geometry and
+// permissions used if the shared memory is created.
+// There must be at least two blocks, and the size must
+// be positive.
+type addrOptions struct {
+	name string
+
+	blockCount, blockSize int
+	perm                  os.FileMode
+
+	// geometry is set if either blocks or size was
+	// given.
+	geometry bool
+}
+
+func parseAddr(address string) (*addrOptions, error) {
+	opts := &addrOptions{
+		name: address,
+
+		blockCount: defaultBlockCount,
+		blockSize:  defaultBlockSize,
+		perm:       defaultPerm,
+	}
+
+	if !strings.HasPrefix(address, "shm:") {
+		if address == "" {
+			return nil, errors.New("invalid address")
+		}
+
+		return opts, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.name = u.Path
+	if u.Host != "" {
+		opts.name = "/" + u.Host + u.Path
+	}
+
+	if opts.name == "" || opts.name == "/" || u.User != nil || u.Fragment != "" {
+		return nil, errors.New("invalid address")
+	}
+
+	for k, v := range u.Query() {
+		if len(v) != 1 {
+			return nil, errors.New("invalid address option " + k)
+		}
+
+		valid := true
+
+		switch k {
+		case "blocks":
+			opts.blockCount, err = strconv.Atoi(v[0])
+			opts.geometry = true
+			valid = opts.blockCount >= 2
+		case "size":
+			opts.blockSize, err = strconv.Atoi(v[0])
+			opts.geometry = true
+			valid = opts.blockSize > 0
+		case "perm":
+			var perm uint64
+			perm, err = strconv.ParseUint(v[0], 8, 32)
+			opts.perm = os.FileMode(perm) & os.ModePerm
+		default:
+			return nil, errors.New("unrecognised address option " + k)
+		}
+
+		if err != nil || !valid {
+			return nil, errors.New("invalid address option " + k)
+		}
+	}
+
+	return opts, nil
+}
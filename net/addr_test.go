@@ -0,0 +1,30 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package net
+
+import "testing"
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		valid   bool
+	}{
+		{"/name", true},
+		{"shm:///name?blocks=2&size=64&perm=0644", true},
+		{"shm://name", true},
+		{"", false},
+		{"shm:///", false},
+		{"shm:///name?blocks=1", false},
+		{"shm:///name?blocks=-4", false},
+		{"shm:///name?size=0", false},
+		{"shm:///name?size=-64", false},
+		{"shm:///name?bogus=1", false},
+	} {
+		if _, err := parseAddr(tc.address); (err == nil) != tc.valid {
+			t.Errorf("parseAddr(%q) returned %v", tc.address, err)
+		}
+	}
+}
@@ -6,23 +6,289 @@
 package net
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/tmthrgd/shm-go"
 )
 
+// closeTimeout bounds how long Close waits for the peer
+// to close its end of the stream.
+const closeTimeout = 5 * time.Second
+
+// ErrCloseTimeout is returned by Close if the peer did
+// not close its end of the stream in time.
+var ErrCloseTimeout = errors.New("peer did not close the connection")
+
+// Conn is a stream connection over a duplex shared
+// memory. Writes are split across as many blocks as
+// they need, and reads are served from a partially
+// consumed block until it is exhausted. An empty block
+// sent by the Dialer opens the stream, and one sent by
+// either end closes it.
+//
+// A shared memory carries one Conn at a time.
 type Conn struct {
 	*shm.ReadWriteCloser
 	name string
 
-	mut *sync.Mutex
+	// done is cancelled once the Listener has been
+	// closed.
+	done    context.Context
+	release func()
+
+	// closing is cancelled by stop when Close is
+	// called, it stops any blocked Read or Write.
+	closing context.Context
+	stop    context.CancelFunc
+
+	readMut sync.Mutex
+	buf     shm.Buffer
+	off     int
+	held    bool
+	eof     bool
+
+	writeMut sync.Mutex
+
+	deadlineMut   sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readCancel and writeCancel stop the wait of a
+	// blocked Read or Write, so that it starts again
+	// with a new deadline.
+	readCancel  context.CancelFunc
+	writeCancel context.CancelFunc
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+func newConn(rw *shm.ReadWriteCloser, name string, done context.Context, release func()) *Conn {
+	closing, stop := context.WithCancel(context.Background())
+
+	return &Conn{
+		ReadWriteCloser: rw,
+		name:            name,
+
+		done:    done,
+		release: release,
+
+		closing: closing,
+		stop:    stop,
+	}
+}
+
+// wait calls get until it returns a buffer. It returns
+// ctx.Err() once ctx is done, or os.ErrDeadlineExceeded
+// once *deadline has passed. A zero deadline waits
+// forever.
+//
+// *deadline is read, and *cancel set to stop the call
+// to get, while deadlineMut is held, so that a deadline
+// set while get is blocked takes effect at once.
+func (c *Conn) wait(ctx context.Context, get func(context.Context) (shm.Buffer, error), deadline *time.Time, cancel *context.CancelFunc) (shm.Buffer, error) {
+	for {
+		c.deadlineMut.Lock()
+
+		if err := ctx.Err(); err != nil {
+			c.deadlineMut.Unlock()
+			return shm.Buffer{}, err
+		}
+
+		waitCtx, stop := context.WithCancel(ctx)
+		if !deadline.IsZero() {
+			waitCtx, stop = context.WithDeadline(ctx, *deadline)
+		}
+
+		*cancel = stop
+		c.deadlineMut.Unlock()
+
+		buf, err := get(waitCtx)
+		stop()
+
+		switch {
+		case err != context.Canceled && err != context.DeadlineExceeded:
+			return buf, err
+		case ctx.Err() != nil:
+			return buf, ctx.Err()
+		case err == context.DeadlineExceeded:
+			return buf, os.ErrDeadlineExceeded
+		}
+
+		// The deadline was changed.
+	}
+}
+
+// closedError returns net.ErrClosed in place of the
+// error of a wait stopped by Close.
+func closedError(err error) error {
+	if err == context.Canceled {
+		return net.ErrClosed
+	}
+
+	return err
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+
+	if c.closing.Err() != nil {
+		return 0, net.ErrClosed
+	}
+
+	n, err = c.read(c.closing, p, &c.readDeadline, &c.readCancel)
+	return n, closedError(err)
+}
+
+// read reads from the stream, as by wait.
+func (c *Conn) read(ctx context.Context, p []byte, deadline *time.Time, cancel *context.CancelFunc) (n int, err error) {
+	for {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if !c.held {
+			if c.buf, err = c.wait(ctx, c.ReadWriteCloser.GetReadBufferContext, deadline, cancel); err != nil {
+				return 0, err
+			}
+
+			c.off, c.held = 0, true
+			c.eof = len(c.buf.Data) == 0
+		}
+
+		if c.off < len(c.buf.Data) {
+			n = copy(p, c.buf.Data[c.off:])
+			c.off += n
+
+			if c.off == len(c.buf.Data) {
+				c.held = false
+				err = c.ReadWriteCloser.SendReadBuffer(c.buf)
+			}
+
+			return n, err
+		}
+
+		c.held = false
+		if err = c.ReadWriteCloser.SendReadBuffer(c.buf); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+
+	if c.closing.Err() != nil {
+		return 0, net.ErrClosed
+	}
+
+	for len(p) > 0 {
+		buf, err := c.wait(c.closing, c.ReadWriteCloser.GetWriteBufferContext, &c.writeDeadline, &c.writeCancel)
+		if err != nil {
+			return n, closedError(err)
+		}
+
+		nn := copy(buf.Data[:cap(buf.Data)], p)
+		buf.Data = buf.Data[:nn]
+
+		if _, err = c.ReadWriteCloser.SendWriteBuffer(buf); err != nil {
+			return n, err
+		}
+
+		n += nn
+		p = p[nn:]
+	}
+
+	return n, nil
+}
+
+// ReadFrom and WriteTo hide those of the embedded
+// ReadWriteCloser, which know nothing of the stream.
+
+type writerOnly struct{ io.Writer }
+
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	return io.Copy(writerOnly{c}, r)
+}
+
+type readerOnly struct{ io.Reader }
+
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	return io.Copy(w, readerOnly{c})
+}
+
+// Close ends the stream and waits for the peer to
+// close its end, discarding anything it sends until
+// then. This leaves nothing in the shared memory for
+// the next Conn. Any blocked Read or Write returns
+// net.ErrClosed, as does any later call.
+//
+// If the peer has not closed its end within a few
+// seconds, perhaps because it has exited, Close gives
+// up and returns ErrCloseTimeout. Anything the peer
+// sends later is left for the next Conn. Close also
+// stops waiting once the Listener has been closed, as
+// the shared memory is then closed with the Conn.
 func (c *Conn) Close() error {
-	c.mut.Unlock()
-	return nil
+	c.closeOnce.Do(func() {
+		defer c.release()
+
+		c.stop()
+
+		ctx, cancel := context.WithTimeout(c.done, closeTimeout)
+		defer cancel()
+
+		c.writeMut.Lock()
+		err := sendEmpty(ctx, c.ReadWriteCloser)
+		c.writeMut.Unlock()
+
+		if err == nil {
+			c.readMut.Lock()
+
+			var (
+				scratch  [512]byte
+				deadline time.Time
+				stop     context.CancelFunc
+			)
+			for err == nil {
+				_, err = c.read(ctx, scratch[:], &deadline, &stop)
+			}
+
+			c.readMut.Unlock()
+		}
+
+		switch err {
+		case io.EOF, context.Canceled:
+		case context.DeadlineExceeded:
+			c.closeErr = ErrCloseTimeout
+		default:
+			c.closeErr = err
+		}
+	})
+
+	return c.closeErr
+}
+
+// sendEmpty sends an empty block, which opens or closes
+// the stream. It waits for a free block until ctx is
+// done.
+func sendEmpty(ctx context.Context, rw *shm.ReadWriteCloser) error {
+	buf, err := rw.GetWriteBufferContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf.Data = buf.Data[:0]
+	_, err = rw.SendWriteBuffer(buf)
+	return err
 }
 
 func (c *Conn) LocalAddr() net.Addr {
@@ -33,14 +299,40 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return addr(c.name)
 }
 
+// SetDeadline sets both the read and write deadlines,
+// see net.Conn. A deadline set while a Read or Write is
+// blocked takes effect at once.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.interrupt(c.readCancel, c.writeCancel)
+	c.deadlineMut.Unlock()
 	return nil
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	c.readDeadline = t
+	c.interrupt(c.readCancel)
+	c.deadlineMut.Unlock()
 	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	c.writeDeadline = t
+	c.interrupt(c.writeCancel)
+	c.deadlineMut.Unlock()
 	return nil
 }
+
+// interrupt stops the waits of any blocked Read or
+// Write, which start again with their new deadline.
+// Stopping a wait that has since finished does nothing.
+func (c *Conn) interrupt(cancels ...context.CancelFunc) {
+	for _, cancel := range cancels {
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package net
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+)
+
+// connect returns both ends of a connection over a new
+// Listener.
+func connect(t *testing.T, blockCount, blockSize int) (l *Listener, client, server net.Conn) {
+	name := testName(t)
+
+	l, err := Listen(name, 0600, blockCount, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+		shm.Unlink(name)
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+
+		accepted <- c
+	}()
+
+	if client, err = Dial(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if server = <-accepted; server == nil {
+		t.FailNow()
+	}
+
+	return l, client, server
+}
+
+// TestConnCloseTimeout checks that Close gives up
+// waiting for a peer that never closes its end.
+func TestConnCloseTimeout(t *testing.T) {
+	_, client, server := connect(t, 4, 64)
+
+	start := time.Now()
+
+	if err := client.Close(); err != ErrCloseTimeout {
+		t.Fatalf("Close returned %v, expected %v", err, ErrCloseTimeout)
+	}
+
+	if took := time.Since(start); took < closeTimeout || took > closeTimeout+2*time.Second {
+		t.Errorf("Close took %s, expected %s", took, closeTimeout)
+	}
+
+	// The peer still sees the stream end.
+	errc := make(chan error, 1)
+	go func() { errc <- server.Close() }()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(closeTimeout + 2*time.Second):
+		t.Fatal("peer Close did not return")
+	}
+}
+
+// TestConnClose checks that Close returns as soon as
+// the peer closes its end.
+func TestConnClose(t *testing.T) {
+	_, client, server := connect(t, 4, 64)
+
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		errc <- server.Close()
+	}()
+
+	start := time.Now()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if took := time.Since(start); took > closeTimeout/2 {
+		t.Errorf("Close took %s after the peer closed", took)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConnClosed checks that a Read or Write blocked
+// when Close is called, or called after it, returns
+// net.ErrClosed.
+func TestConnClosed(t *testing.T) {
+	_, client, server := connect(t, 4, 64)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The server is only closed once the Read has
+	// returned, as it would otherwise read its EOF.
+	errc := make(chan error, 2)
+	go func() { errc <- client.Close() }()
+
+	select {
+	case err := <-read:
+		if err != net.ErrClosed {
+			t.Errorf("blocked Read returned %v, expected %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Read did not return after Close")
+	}
+
+	go func() { errc <- server.Close() }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Errorf("Read returned %v after Close, expected %v", err, net.ErrClosed)
+	}
+
+	if _, err := client.Write([]byte("x")); err != net.ErrClosed {
+		t.Errorf("Write returned %v after Close, expected %v", err, net.ErrClosed)
+	}
+}
+
+// TestConnWriteDeadline checks that a deadline set
+// while a Write is blocked on a full ring stops it.
+func TestConnWriteDeadline(t *testing.T) {
+	_, client, server := connect(t, 4, 64)
+
+	write := make(chan error, 1)
+	go func() {
+		// Far more than the ring holds.
+		_, err := client.Write(make([]byte, 64*64))
+		write <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := client.SetWriteDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-write:
+		if !os.IsTimeout(err) {
+			t.Fatalf("blocked Write returned %v, expected a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Write ignored its deadline")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Close() }()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestListenerClosed checks that an Accept blocked when
+// the Listener is closed, or called after it, returns
+// net.ErrClosed.
+func TestListenerClosed(t *testing.T) {
+	name := testName(t)
+
+	l, err := Listen(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shm.Unlink(name)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-accepted:
+		if err != net.ErrClosed {
+			t.Errorf("blocked Accept returned %v, expected %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Accept did not return after Close")
+	}
+
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Errorf("Accept returned %v after Close, expected %v", err, net.ErrClosed)
+	}
+}
@@ -6,48 +6,186 @@
 package net
 
 import (
+	"context"
 	"errors"
 	"net"
+	"os"
 	"sync"
 
 	"github.com/tmthrgd/shm-go"
 )
 
+// Dialer connects to a Listener over a duplex shared
+// memory. As the shared memory carries one Conn at a
+// time, Dial waits for the last Conn to be closed.
 type Dialer struct {
 	rw   *shm.ReadWriteCloser
 	name string
 
-	mut sync.Mutex
+	conn chan struct{}
 }
 
-func Dial(name string) (net.Conn, error) {
-	rw, err := shm.OpenDuplex(name)
+// dialers holds the Dialer for each shared memory
+// opened by DialContext, so that connections to the
+// same shared memory take turns.
+var dialers = struct {
+	sync.Mutex
+	m map[string]*dialerRef
+}{m: make(map[string]*dialerRef)}
+
+type dialerRef struct {
+	d    *Dialer
+	refs int
+}
+
+// Dial connects to the shared memory at address, as by
+// DialContext.
+func Dial(address string) (net.Conn, error) {
+	return DialContext(context.Background(), "shm", address)
+}
+
+// DialContext connects to the shared memory at address,
+// which may be a name or a shm:// URL, see ListenAddr.
+// The network must be "shm".
+//
+// The shared memory is opened on demand, and closed
+// once every Conn to it has been closed. If it does
+// not yet exist and the address gives a blocks or size
+// option, it is created for the Listener to open.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "shm" {
+		return nil, errors.New("unrecognised network")
+	}
+
+	opts, err := parseAddr(address)
 	if err != nil {
 		return nil, err
 	}
 
-	return (&Dialer{
-		rw:   rw,
-		name: name,
-	}).Dial("shm", name)
+	d, err := acquireDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dial(ctx, func() { releaseDialer(d) })
+	if err != nil {
+		releaseDialer(d)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func acquireDialer(opts *addrOptions) (*Dialer, error) {
+	dialers.Lock()
+	defer dialers.Unlock()
+
+	if ref := dialers.m[opts.name]; ref != nil {
+		ref.refs++
+		return ref.d, nil
+	}
+
+	rw, err := openAddr(opts, opts.geometry)
+	if err != nil {
+		return nil, err
+	}
+
+	d := NewDialer(rw, opts.name)
+	dialers.m[opts.name] = &dialerRef{d, 1}
+	return d, nil
+}
+
+func releaseDialer(d *Dialer) {
+	dialers.Lock()
+	defer dialers.Unlock()
+
+	ref := dialers.m[d.name]
+	if ref.refs--; ref.refs == 0 {
+		delete(dialers.m, d.name)
+		d.rw.Close()
+	}
+}
+
+// openAddr opens the shared memory described by opts,
+// creating it if it does not exist and create is set.
+func openAddr(opts *addrOptions, create bool) (*shm.ReadWriteCloser, error) {
+	rw, err := shm.OpenDuplex(opts.name)
+	if !create || !os.IsNotExist(err) {
+		return rw, err
+	}
+
+	rw, err = shm.CreateDuplex(opts.name, opts.perm, opts.blockCount, opts.blockSize)
+	if os.IsExist(err) {
+		// Another process created it first.
+		return shm.OpenDuplex(opts.name)
+	}
+
+	return rw, err
 }
 
 func NewDialer(rw *shm.ReadWriteCloser, name string) *Dialer {
 	return &Dialer{
 		rw:   rw,
 		name: name,
+
+		conn: make(chan struct{}, 1),
 	}
 }
 
 func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but gives up waiting for the
+// last Conn to be closed once ctx is done. The address
+// must name the Dialer's shared memory, either as a
+// name or a shm:// URL, whose options are ignored.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	if network != "shm" {
 		return nil, errors.New("unrecognised network")
 	}
 
-	if address != d.name {
+	if opts, err := parseAddr(address); err != nil || opts.name != d.name {
 		return nil, errors.New("invalid address")
 	}
 
-	d.mut.Lock()
-	return &Conn{d.rw, d.name, &d.mut}, nil
+	return d.dial(ctx, nil)
+}
+
+// dial waits for the last Conn to be closed and opens a
+// new one. done, if not nil, is called once the new
+// Conn has been closed.
+func (d *Dialer) dial(ctx context.Context, done func()) (*Conn, error) {
+	select {
+	case d.conn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := sendEmpty(ctx, d.rw); err != nil {
+		<-d.conn
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	return newConn(d.rw, d.name, context.Background(), func() {
+		<-d.conn
+
+		if done != nil {
+			done()
+		}
+	}), nil
+}
+
+// ContextDialer returns a function that dials the
+// shared memory, as by DialContext, whatever address it
+// is given. It may be passed to grpc.WithContextDialer.
+func (d *Dialer) ContextDialer() func(ctx context.Context, address string) (net.Conn, error) {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		return d.dial(ctx, nil)
+	}
 }
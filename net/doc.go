@@ -0,0 +1,28 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Package net provides a net.Listener and net.Conn over
+// a duplex shared memory.
+//
+// A shared memory carries a single stream connection at
+// a time. Protocols that multiplex concurrent streams
+// over one connection, such as HTTP/2 and gRPC, may use
+// it as they would TCP. For gRPC:
+//
+//	l, err := net.ListenAddr("shm:///grpc?blocks=64&size=4096")
+//	...
+//	go grpcServer.Serve(l)
+//
+//	cc, err := grpc.NewClient("passthrough:///grpc",
+//		grpc.WithContextDialer(func(ctx context.Context, addr string) (stdnet.Conn, error) {
+//			return net.DialContext(ctx, "shm", "/"+addr)
+//		}),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// DialContext opens the shared memory on demand and
+// shares it between connections to the same name, so
+// it may stand in for net.Dialer.DialContext wherever
+// the network can be set to "shm".
+package net
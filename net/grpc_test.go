@@ -0,0 +1,195 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package net
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testName returns a shared memory name unique to the
+// test t.
+func testName(t testing.TB) string {
+	return fmt.Sprintf("/shm-go-net-test-%s-%d", strings.Replace(t.Name(), "/", "-", -1), os.Getpid())
+}
+
+// TestGRPC checks that a grpc.Server and client can
+// exchange unary and streaming calls over a Listener
+// and DialContext.
+func TestGRPC(t *testing.T) {
+	name := testName(t)
+
+	l, err := Listen(name, 0600, 64, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shm.Unlink(name)
+
+	hs := health.NewServer()
+
+	// Fixed window sizes turn off grpc's bandwidth
+	// estimator, whose pings synchronise through the
+	// shared memory, where the race detector cannot see.
+	const window = 1 << 20
+
+	srv := grpc.NewServer(grpc.InitialWindowSize(window), grpc.InitialConnWindowSize(window))
+	healthpb.RegisterHealthServer(srv, hs)
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	cc, err := grpc.NewClient("passthrough:///"+name,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithInitialWindowSize(window), grpc.WithInitialConnWindowSize(window),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return DialContext(ctx, "shm", name)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := healthpb.NewHealthClient(cc)
+
+	hs.SetServingStatus("shm", healthpb.HealthCheckResponse_SERVING)
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "shm"})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Check returned %v, expected SERVING", resp.Status)
+	}
+
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "shm"})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	for _, expect := range []healthpb.HealthCheckResponse_ServingStatus{
+		healthpb.HealthCheckResponse_SERVING,
+		healthpb.HealthCheckResponse_NOT_SERVING,
+		healthpb.HealthCheckResponse_SERVING,
+	} {
+		resp, err := watch.Recv()
+		if err != nil {
+			t.Fatalf("Watch.Recv failed: %v", err)
+		}
+		if resp.Status != expect {
+			t.Fatalf("Watch returned %v, expected %v", resp.Status, expect)
+		}
+
+		if expect == healthpb.HealthCheckResponse_SERVING {
+			hs.SetServingStatus("shm", healthpb.HealthCheckResponse_NOT_SERVING)
+		} else {
+			hs.SetServingStatus("shm", healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+
+	if err := cc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Stop()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Serve did not return")
+	}
+}
+
+// TestConnDeadline checks that a deadline set while a
+// Read is blocked stops it.
+func TestConnDeadline(t *testing.T) {
+	name := testName(t)
+
+	l, err := Listen(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shm.Unlink(name)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+
+		accepted <- c
+	}()
+
+	c, err := Dial(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := <-accepted
+	if sc == nil {
+		t.FailNow()
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Read(make([]byte, 1)); !os.IsTimeout(err) {
+		t.Fatalf("Read with past deadline returned %v, expected a timeout", err)
+	}
+
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := c.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-read:
+		if !os.IsTimeout(err) {
+			t.Fatalf("blocked Read returned %v, expected a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Read ignored its deadline")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- sc.Close() }()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@
 package net
 
 import (
+	"context"
 	"net"
 	"os"
 	"sync"
@@ -13,11 +14,26 @@ import (
 	"github.com/tmthrgd/shm-go"
 )
 
+// Listener accepts connections from a Dialer over a
+// duplex shared memory. As the shared memory carries
+// one Conn at a time, Accept waits for the last Conn to
+// be closed and for a Dialer to connect.
+//
+// It may be used with grpc.Server and http.Server, both
+// of which serve each accepted Conn concurrently with
+// the next call to Accept.
 type Listener struct {
 	rw   *shm.ReadWriteCloser
 	name string
 
-	mut sync.Mutex
+	conn chan struct{}
+
+	// closed is cancelled by stop when Close is called.
+	closed context.Context
+	stop   context.CancelFunc
+
+	mut       sync.RWMutex
+	closeOnce sync.Once
 }
 
 func Listen(name string, perm os.FileMode, blockCount, blockSize int) (*Listener, error) {
@@ -26,26 +42,128 @@ func Listen(name string, perm os.FileMode, blockCount, blockSize int) (*Listener
 		return nil, err
 	}
 
-	return &Listener{
-		rw:   rw,
-		name: name,
-	}, nil
+	return NewListener(rw, name), nil
+}
+
+// ListenAddr listens on the shared memory at address,
+// which is either a name, such as "/name", or a URL of
+// the form
+//
+//	shm:///name?blocks=1024&size=8192&perm=0600
+//
+// The shared memory is created with the given number
+// and size of blocks and permissions, or opened if a
+// Dialer has already created it. Options that are not
+// given take the defaults shown.
+func ListenAddr(address string) (*Listener, error) {
+	opts, err := parseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := openAddr(opts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(rw, opts.name), nil
 }
 
 func NewListener(rw *shm.ReadWriteCloser, name string) *Listener {
+	closed, stop := context.WithCancel(context.Background())
+
 	return &Listener{
 		rw:   rw,
 		name: name,
+
+		conn: make(chan struct{}, 1),
+
+		closed: closed,
+		stop:   stop,
 	}
 }
 
+// Accept waits for the next connection. It returns
+// net.ErrClosed once the Listener has been closed.
 func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case l.conn <- struct{}{}:
+	case <-l.closed.Done():
+		return nil, net.ErrClosed
+	}
+
+	if err := l.waitDialer(); err != nil {
+		l.release()
+		return nil, err
+	}
+
+	return newConn(l.rw, l.name, l.closed, l.release), nil
+}
+
+// release is called when the open Conn is closed. If
+// the Listener was closed in the meantime, it closes
+// the shared memory.
+func (l *Listener) release() {
 	l.mut.Lock()
-	return &Conn{l.rw, l.name, &l.mut}, nil
+	defer l.mut.Unlock()
+
+	<-l.conn
+
+	if l.closed.Err() != nil {
+		l.rw.Close()
+	}
+}
+
+// waitDialer waits for the empty block a Dialer sends
+// when it connects, discarding anything sent before it.
+func (l *Listener) waitDialer() error {
+	for {
+		l.mut.RLock()
+
+		if l.closed.Err() != nil {
+			l.mut.RUnlock()
+			return net.ErrClosed
+		}
+
+		buf, err := l.rw.GetReadBufferContext(l.closed)
+		if err == nil {
+			err = l.rw.SendReadBuffer(buf)
+		}
+
+		l.mut.RUnlock()
+
+		if err == context.Canceled {
+			return net.ErrClosed
+		}
+
+		if err != nil || len(buf.Data) == 0 {
+			return err
+		}
+	}
 }
 
+// Close stops Accept and closes the shared memory. If
+// a Conn is open, the shared memory is instead closed
+// with it, so that it may still end the stream.
 func (l *Listener) Close() error {
-	return l.rw.Close()
+	var err error
+
+	l.closeOnce.Do(func() {
+		// Stop a blocked Accept first, so that it gives
+		// up mut.
+		l.stop()
+
+		l.mut.Lock()
+		defer l.mut.Unlock()
+
+		select {
+		case l.conn <- struct{}{}:
+			err = l.rw.Close()
+		default:
+		}
+	})
+
+	return err
 }
 
 func (l *Listener) Addr() net.Addr {
@@ -0,0 +1,389 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/tmthrgd/go-shm"
+)
+
+// Observer is a read-only view of shared memory for
+// use by monitoring tools.
+//
+// An Observer maps the shared memory without write
+// access and never takes part in flow control, it is
+// invisible to the attached readers and writers.
+//
+// Read and Write are named from the perspective of
+// the process that called Create*.
+type Observer struct {
+	name string
+
+	data        []byte
+	readShared  *sharedMem
+	writeShared *sharedMem
+	metadata    []byte
+
+	// root maps the header of generation 0, which holds
+	// the flags, when a later generation is observed.
+	root  []byte
+	flags *sharedMem
+
+	// mapping is held for reading while the shared
+	// memory is read, Close holds it for writing to
+	// unmap it.
+	mapping sync.RWMutex
+
+	closed uint32
+}
+
+// RingHeader is a snapshot of the header of a single
+// ring of blocks.
+type RingHeader struct {
+	BlockCount int
+	BlockSize  int
+
+	ReadStart, ReadEnd   uint32
+	WriteStart, WriteEnd uint32
+}
+
+// Header is a snapshot of the header of the shared
+// memory.
+type Header struct {
+	Version Version
+
+	Features         uint32
+	IncompatFeatures uint32
+
+	Duplex bool
+
+	// Generation is the number of times the shared
+	// memory has been resized. Read and Write describe
+	// the rings of this generation.
+	Generation int
+
+	// CreatorPID is the process ID of the process that
+	// called Create*, or Resize for later generations.
+	CreatorPID int
+	// RootCreatorPID is the process ID of the process
+	// that called Create*. It only differs from
+	// CreatorPID once the shared memory has been
+	// resized.
+	RootCreatorPID int
+
+	Read, Write RingHeader
+
+	Flags [sharedFlagsSize]uint32
+}
+
+// OpenObserver maps the named shared memory read-only.
+// Both simplex and duplex shared memory are supported,
+// broadcast and mailbox shared memory are not.
+//
+// For resizable shared memory, the latest generation
+// is observed.
+func OpenObserver(name string) (*Observer, error) {
+	return openObserver(name, name)
+}
+
+func openObserver(name, path string) (*Observer, error) {
+	file, err := shm.Open(path, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	l, shared, data, err := readLayout(file, unix.PROT_READ)
+	if err != nil {
+		return nil, err
+	}
+
+	// The blocks of broadcast and mailbox shared memory
+	// are not released through ReadEnd, so a Tap could
+	// not tell which of them hold sent data.
+	switch incompat := uint32(shared.IncompatFeatures); {
+	case incompat&incompatBroadcast != 0:
+		unix.Munmap(data)
+		return nil, ErrBroadcast
+	case incompat&incompatMailbox != 0:
+		unix.Munmap(data)
+		return nil, ErrMailbox
+	}
+
+	if path == name && uint32(shared.IncompatFeatures)&incompatResizable != 0 {
+		if latest := atomic.LoadUint32((*uint32)(&shared.LatestGeneration)); latest != 0 {
+			o, err := openObserver(name, generationName(name, latest))
+			if err != nil {
+				unix.Munmap(data)
+				return nil, err
+			}
+
+			// Keep generation 0 mapped for its flags.
+			o.root, o.flags = data, shared
+			return o, nil
+		}
+	}
+
+	return &Observer{
+		name: name,
+
+		data:        data,
+		readShared:  shared,
+		writeShared: (*sharedMem)(unsafe.Pointer(&data[l.offsets[1]])),
+		metadata:    append([]byte(nil), data[l.metadataOffset:l.size]...),
+
+		flags: shared,
+	}, nil
+}
+
+func (o *Observer) Close() error {
+	o.mapping.Lock()
+	defer o.mapping.Unlock()
+
+	if !atomic.CompareAndSwapUint32(&o.closed, 0, 1) {
+		return nil
+	}
+
+	if o.root != nil {
+		unix.Munmap(o.root)
+	}
+
+	return unix.Munmap(o.data)
+}
+
+// Name returns the name of the shared memory.
+func (o *Observer) Name() string {
+	return o.name
+}
+
+// Metadata returns a copy of the application-defined
+// metadata that was passed in CreateOptions when the
+// shared memory was created.
+//
+// It returns nil if no metadata was set.
+func (o *Observer) Metadata() []byte {
+	if len(o.metadata) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), o.metadata...)
+}
+
+// Header returns a snapshot of the header of the
+// shared memory. Once o has been closed, Header returns
+// the zero Header.
+func (o *Observer) Header() Header {
+	o.mapping.RLock()
+	defer o.mapping.RUnlock()
+
+	if atomic.LoadUint32(&o.closed) != 0 {
+		return Header{}
+	}
+
+	h := Header{
+		Version: Version{uint16(o.readShared.MajorVersion), uint16(o.readShared.MinorVersion)},
+
+		Features:         uint32(o.readShared.Features),
+		IncompatFeatures: uint32(o.readShared.IncompatFeatures),
+
+		Duplex: o.readShared != o.writeShared,
+
+		Generation: int(o.readShared.Generation),
+
+		CreatorPID:     int(o.readShared.CreatorPID),
+		RootCreatorPID: int(o.flags.CreatorPID),
+
+		Read:  ringHeader(o.readShared),
+		Write: ringHeader(o.writeShared),
+	}
+
+	for i := range h.Flags {
+		h.Flags[i] = atomic.LoadUint32((*uint32)(&o.flags.Flags[i]))
+	}
+
+	return h
+}
+
+func ringHeader(shared *sharedMem) RingHeader {
+	return RingHeader{
+		BlockCount: int(shared.BlockCount),
+		BlockSize:  int(shared.BlockSize),
+
+		ReadStart:  atomic.LoadUint32((*uint32)(&shared.ReadStart)),
+		ReadEnd:    atomic.LoadUint32((*uint32)(&shared.ReadEnd)),
+		WriteStart: atomic.LoadUint32((*uint32)(&shared.WriteStart)) &^ sealedBit,
+		WriteEnd:   atomic.LoadUint32((*uint32)(&shared.WriteEnd)),
+	}
+}
+
+// Stats returns the current statistics of the shared
+// memory. Once o has been closed, Stats returns the
+// zero Stats.
+func (o *Observer) Stats() Stats {
+	o.mapping.RLock()
+	defer o.mapping.RUnlock()
+
+	if atomic.LoadUint32(&o.closed) != 0 {
+		return Stats{}
+	}
+
+	return Stats{
+		Duplex: o.readShared != o.writeShared,
+
+		Read:  ringStats(o.readShared),
+		Write: ringStats(o.writeShared),
+	}
+}
+
+// ReadTap returns a Tap on the blocks sent to the
+// ring read by the creator.
+func (o *Observer) ReadTap() *Tap {
+	return o.newTap(o.readShared)
+}
+
+// WriteTap returns a Tap on the blocks sent to the
+// ring written by the creator. For simplex shared
+// memory it is equivalent to ReadTap.
+func (o *Observer) WriteTap() *Tap {
+	return o.newTap(o.writeShared)
+}
+
+func (o *Observer) newTap(shared *sharedMem) *Tap {
+	o.mapping.RLock()
+	defer o.mapping.RUnlock()
+
+	if atomic.LoadUint32(&o.closed) != 0 {
+		// Next fails without touching shared.
+		return &Tap{o: o}
+	}
+
+	return &Tap{
+		o:      o,
+		shared: shared,
+
+		fullBlockSize: blockHeaderSize + uint64(shared.BlockSize),
+		headerSize:    uint64(shared.HeaderSize),
+
+		next: atomic.LoadUint32((*uint32)(&shared.WriteEnd)),
+	}
+}
+
+// Tap copies blocks as they are sent to a ring,
+// without consuming them.
+//
+// A Tap starts at the first block sent after it was
+// created. Blocks that are released by a reader
+// before the Tap has copied them are skipped and
+// counted by Dropped.
+type Tap struct {
+	o      *Observer
+	shared *sharedMem
+
+	fullBlockSize uint64
+	headerSize    uint64
+
+	next    uint32
+	dropped uint64
+}
+
+// Next copies the next block sent to the ring into p
+// and returns the number of bytes copied along with
+// the flags of the block. If len(p) is less than the
+// size of the block, the remainder is discarded.
+//
+// Next never blocks, it returns ErrNotReady if no new
+// block has been sent.
+func (t *Tap) Next(p []byte) (n int, flags [blockFlagsSize]byte, err error) {
+	t.o.mapping.RLock()
+	defer t.o.mapping.RUnlock()
+
+	if atomic.LoadUint32(&t.o.closed) != 0 {
+		return 0, flags, io.ErrClosedPipe
+	}
+
+	blockCount := uint32(t.shared.BlockCount)
+	blocks := uintptr(unsafe.Pointer(t.shared)) + uintptr(t.headerSize)
+
+	// published reports whether t.next is in
+	// [ReadEnd, WriteEnd), the blocks that have been
+	// sent but not yet released by a reader.
+	published := func() (ok, behind bool) {
+		readEnd := atomic.LoadUint32((*uint32)(&t.shared.ReadEnd))
+		writeEnd := atomic.LoadUint32((*uint32)(&t.shared.WriteEnd))
+
+		pos := (t.next + blockCount - readEnd) % blockCount
+		end := (writeEnd + blockCount - readEnd) % blockCount
+
+		if pos < end {
+			return true, false
+		}
+
+		return false, t.next != writeEnd
+	}
+
+	for {
+		if t.next >= blockCount {
+			return 0, flags, ErrInvalidSharedMemory
+		}
+
+		ok, behind := published()
+		if behind {
+			t.skipToReadEnd()
+			continue
+		}
+
+		if !ok {
+			return 0, flags, ErrNotReady
+		}
+
+		block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(t.next)*t.fullBlockSize)))
+
+		// Blocks are numbered as they are sent, so a
+		// block that was reused and sent again, while it
+		// was being copied, has a different number.
+		seq := atomic.LoadUint32((*uint32)(&block.Seq))
+
+		size := uint64(block.Size)
+		if size > uint64(t.shared.BlockSize) {
+			size = uint64(t.shared.BlockSize)
+		}
+
+		data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+		n = copy(p, data[:size])
+		flags = block.Flags
+
+		if ok, _ = published(); !ok || atomic.LoadUint32((*uint32)(&block.Seq)) != seq {
+			// The block was released, and possibly
+			// reused, while it was being copied.
+			t.skipToReadEnd()
+			continue
+		}
+
+		t.next = uint32(block.Next)
+		return n, flags, nil
+	}
+}
+
+func (t *Tap) skipToReadEnd() {
+	blockCount := uint32(t.shared.BlockCount)
+	readEnd := atomic.LoadUint32((*uint32)(&t.shared.ReadEnd))
+
+	t.dropped += uint64((readEnd + blockCount - t.next) % blockCount)
+	t.next = readEnd
+}
+
+// Dropped returns the number of blocks that were
+// released by a reader before the Tap could copy
+// them.
+func (t *Tap) Dropped() uint64 {
+	return t.dropped
+}
@@ -0,0 +1,258 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestObserverTap checks that a Tap copies each block
+// sent to the ring without consuming it.
+func TestObserverTap(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 8, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	o, err := OpenObserver(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	tap := o.ReadTap()
+
+	buf := make([]byte, 64)
+	if _, _, err := tap.Next(buf); err != ErrNotReady {
+		t.Fatalf("Next returned %v, expected %v", err, ErrNotReady)
+	}
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := rw.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, msg := range []string{"one", "two", "three"} {
+		n, _, err := tap.Next(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf[:n]) != msg {
+			t.Errorf("Next returned %q, expected %q", buf[:n], msg)
+		}
+	}
+
+	if h := o.Header(); h.Read.BlockCount != 8 || h.Read.BlockSize != 64 || h.Duplex {
+		t.Errorf("Header returned %+v", h)
+	}
+
+	if s := o.Stats(); s.Read.Readable != 3 {
+		t.Errorf("Stats reported %d readable blocks, expected 3", s.Read.Readable)
+	}
+
+	// The blocks were not consumed.
+	for _, msg := range []string{"one", "two", "three"} {
+		// Each block written by Write ends a message.
+		n, err := rw.Read(buf)
+		if err != io.EOF {
+			t.Fatalf("Read returned %v, expected %v", err, io.EOF)
+		}
+
+		if string(buf[:n]) != msg {
+			t.Errorf("Read returned %q, expected %q", buf[:n], msg)
+		}
+	}
+}
+
+// TestObserverTapConsistent checks that a Tap never
+// returns a block that was reused while it was being
+// copied, even when the ring wraps around during the
+// copy.
+func TestObserverTapConsistent(t *testing.T) {
+	const blockSize = 1 << 16
+
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 2, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	o, err := OpenObserver(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		// Every block is filled with a single byte, so a
+		// torn copy holds more than one.
+		p := make([]byte, blockSize)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				rw.Write(nil)
+				return
+			default:
+			}
+
+			for j := range p {
+				p[j] = byte(i)
+			}
+
+			if _, err := rw.Write(p); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+
+		p := make([]byte, blockSize)
+		for {
+			n, err := rw.Read(p)
+			if err != io.EOF {
+				t.Errorf("Read returned %v, expected %v", err, io.EOF)
+				return
+			}
+
+			if n == 0 {
+				return
+			}
+		}
+	}()
+
+	tap := o.ReadTap()
+	p := make([]byte, blockSize)
+
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); {
+		n, _, err := tap.Next(p)
+		if err == ErrNotReady {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n > 0 && bytes.Count(p[:n], p[:1]) != n {
+			t.Fatal("Next returned a block that changed while it was copied")
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// TestObserverClose checks that Close waits for Header,
+// Stats and Tap.Next rather than unmap the shared
+// memory beneath them.
+func TestObserverClose(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateDuplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	for i := 0; i < 50; i++ {
+		o, err := OpenObserver(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tap := o.WriteTap()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				p := make([]byte, 64)
+				for {
+					o.Stats()
+					tap.Next(p)
+
+					if o.Header().Read.BlockCount == 0 {
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(100 * time.Microsecond)
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Wait()
+	}
+}
+
+// TestOpenObserverUnsupported checks that OpenObserver
+// rejects broadcast and mailbox shared memory, whose
+// blocks a Tap cannot follow.
+func TestOpenObserverUnsupported(t *testing.T) {
+	t.Run("broadcast", func(t *testing.T) {
+		name := testName(t)
+
+		b, err := CreateBroadcast(name, 0600, 4, 64, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		defer b.Unlink()
+
+		if o, err := OpenObserver(name); err != ErrBroadcast {
+			if err == nil {
+				o.Close()
+			}
+
+			t.Fatalf("OpenObserver returned %v, expected %v", err, ErrBroadcast)
+		}
+	})
+
+	t.Run("mailbox", func(t *testing.T) {
+		name := testName(t)
+
+		m, err := CreateMailbox(name, 0600, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		defer m.Unlink()
+
+		if o, err := OpenObserver(name); err != ErrMailbox {
+			if err == nil {
+				o.Close()
+			}
+
+			t.Fatalf("OpenObserver returned %v, expected %v", err, ErrMailbox)
+		}
+	})
+}
@@ -5,103 +5,43 @@
 
 package shm
 
-import (
-	"golang.org/x/sys/unix"
-	"sync/atomic"
-	"unsafe"
-
-	"github.com/tmthrgd/go-shm"
-)
+import "golang.org/x/sys/unix"
 
+// OpenSimplex opens shared memory created by
+// CreateSimplex. It returns ErrInvalidSharedMemory if
+// the shared memory is duplex.
 func OpenSimplex(name string) (*ReadWriteCloser, error) {
-	file, err := shm.Open(name, unix.O_RDWR, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
-
-	data, err := unix.Mmap(int(file.Fd()), 0, sharedHeaderSize, unix.PROT_READ, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-
-	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
-
-	if atomic.LoadUint32((*uint32)(&shared.Version)) != version {
-		return nil, ErrInvalidSharedMemory
-	}
-
-	blockCount, blockSize := uint64(shared.BlockCount), uint64(shared.BlockSize)
-
-	if err = unix.Munmap(data); err != nil {
-		return nil, err
-	}
-
-	size := sharedHeaderSize + (blockHeaderSize+blockSize)*blockCount
-
-	data, err = unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-
-	shared = (*sharedMem)(unsafe.Pointer(&data[0]))
-	return &ReadWriteCloser{
-		name: name,
-
-		data:          data,
-		readShared:    shared,
-		writeShared:   shared,
-		size:          size,
-		fullBlockSize: blockHeaderSize + blockSize,
-
-		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
-	}, nil
+	return open(name, false)
 }
 
+// OpenDuplex opens shared memory created by
+// CreateDuplex. It returns ErrInvalidSharedMemory if
+// the shared memory is simplex.
 func OpenDuplex(name string) (*ReadWriteCloser, error) {
-	file, err := shm.Open(name, unix.O_RDWR, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
+	return open(name, true)
+}
 
-	data, err := unix.Mmap(int(file.Fd()), 0, sharedHeaderSize, unix.PROT_READ, unix.MAP_SHARED)
+func open(name string, duplex bool) (*ReadWriteCloser, error) {
+	root, err := openSegment(name, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
-
-	if atomic.LoadUint32((*uint32)(&shared.Version)) != version {
+	switch {
+	case root.incompat&incompatBroadcast != 0:
+		unix.Munmap(root.data)
+		return nil, ErrBroadcast
+	case root.incompat&incompatMailbox != 0:
+		unix.Munmap(root.data)
+		return nil, ErrMailbox
+	case root.duplex != duplex:
+		unix.Munmap(root.data)
 		return nil, ErrInvalidSharedMemory
 	}
 
-	blockCount, blockSize := uint64(shared.BlockCount), uint64(shared.BlockSize)
-
-	if err = unix.Munmap(data); err != nil {
-		return nil, err
-	}
-
-	sharedSize := sharedHeaderSize + (blockHeaderSize+blockSize)*blockCount
-	size := 2 * sharedSize
-
-	data, err = unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-
-	writeShared := (*sharedMem)(unsafe.Pointer(&data[0]))
-	return &ReadWriteCloser{
-		name: name,
-
-		data:          data,
-		readShared:    (*sharedMem)(unsafe.Pointer(&data[sharedSize])),
-		writeShared:   writeShared,
-		size:          size,
-		fullBlockSize: blockHeaderSize + blockSize,
-
-		Flags: (*[len(writeShared.Flags)]uint32)(unsafe.Pointer(&writeShared.Flags[0])),
-	}, nil
+	// Resizable shared memory is opened at generation 0.
+	// Each direction moves on to later generations as
+	// their rings are sealed and drained, so no block
+	// sent before the shared memory was opened is lost.
+	return newReadWriteCloser(name, root, false), nil
 }
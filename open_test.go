@@ -0,0 +1,158 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import "testing"
+
+// TestOpenWrongType checks that OpenSimplex and
+// OpenDuplex only open shared memory of their own type.
+func TestOpenWrongType(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		create func(name string) (interface{ Close() error }, error)
+		open   func(name string) (*ReadWriteCloser, error)
+		expect error
+	}{
+		{
+			"duplex as simplex",
+			func(name string) (interface{ Close() error }, error) {
+				return CreateDuplex(name, 0600, 4, 64)
+			},
+			OpenSimplex,
+			ErrInvalidSharedMemory,
+		},
+		{
+			"simplex as duplex",
+			func(name string) (interface{ Close() error }, error) {
+				return CreateSimplex(name, 0600, 4, 64)
+			},
+			OpenDuplex,
+			ErrInvalidSharedMemory,
+		},
+		{
+			"broadcast",
+			func(name string) (interface{ Close() error }, error) {
+				return CreateBroadcast(name, 0600, 4, 64, nil)
+			},
+			OpenSimplex,
+			ErrBroadcast,
+		},
+		{
+			"mailbox",
+			func(name string) (interface{ Close() error }, error) {
+				return CreateMailbox(name, 0600, 64)
+			},
+			OpenDuplex,
+			ErrMailbox,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := testName(t)
+
+			c, err := tc.create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			defer Unlink(name)
+
+			if rw, err := tc.open(name); err != tc.expect {
+				if err == nil {
+					rw.Close()
+				}
+
+				t.Fatalf("Open returned %v, expected %v", err, tc.expect)
+			}
+		})
+	}
+}
+
+// TestOpenCorruptHeader checks that Open* and
+// OpenObserver reject a header whose geometry
+// createSegment would not have accepted, rather than
+// mapping blocks that do not exist.
+func TestOpenCorruptHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		duplex  bool
+		corrupt func(first, second *sharedMem)
+	}{
+		{"no blocks", false, func(first, second *sharedMem) {
+			first.BlockCount = 0
+		}},
+		{"one block", false, func(first, second *sharedMem) {
+			first.BlockCount = 1
+		}},
+		{"unaligned block size", false, func(first, second *sharedMem) {
+			first.BlockSize = 100
+		}},
+		{"overflowing block size", false, func(first, second *sharedMem) {
+			first.BlockSize = 1 << 62
+		}},
+		{"unaligned header size", false, func(first, second *sharedMem) {
+			first.HeaderSize = sharedHeaderSize + 8
+		}},
+		{"slab without feature", false, func(first, second *sharedMem) {
+			first.SlabSize = slabHeaderSize
+		}},
+		{"overflowing first ring", true, func(first, second *sharedMem) {
+			first.BlockSize = 1 << 62
+		}},
+		{"second ring one block", true, func(first, second *sharedMem) {
+			second.BlockCount = 1
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := testName(t)
+
+			create, open := CreateSimplex, OpenSimplex
+			if tc.duplex {
+				create, open = CreateDuplex, OpenDuplex
+			}
+
+			rw, err := create(name, 0600, 4, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Close()
+			defer Unlink(name)
+
+			// The header is restored so that rw may be closed.
+			first, second := rw.root.rings[0].shared, rw.root.rings[1].shared
+
+			saved := *first
+			defer func() { *first = saved }()
+
+			if second != nil {
+				saved := *second
+				defer func() { *second = saved }()
+			}
+
+			tc.corrupt(first, second)
+
+			for _, open := range []struct {
+				name string
+				fn   func(name string) (interface{ Close() error }, error)
+			}{
+				{"Open", func(name string) (interface{ Close() error }, error) {
+					return open(name)
+				}},
+				{"OpenObserver", func(name string) (interface{ Close() error }, error) {
+					return OpenObserver(name)
+				}},
+			} {
+				c, err := open.fn(name)
+				if err == nil {
+					c.Close()
+				}
+
+				if err != ErrInvalidSharedMemory {
+					t.Errorf("%s returned %v, expected %v", open.name, err, ErrInvalidSharedMemory)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestOverwrite checks that a writer overwrites the
+// oldest unread blocks of a full ring, and that the
+// reader learns how many it lost.
+func TestOverwrite(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplexWithOptions(name, 0600, 4, 64, &CreateOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	// One block is always kept empty, so the ring holds
+	// the last three blocks written.
+	for i := 0; i < 10; i++ {
+		if _, err := rw.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s := rw.Stats().Read; s.Overwritten != 7 {
+		t.Errorf("Stats reported %d blocks overwritten, expected 7", s.Overwritten)
+	}
+
+	for i, lost := range []int{7, 0, 0} {
+		buf, err := rw.GetReadBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf.Data) != fmt.Sprint(7+i) {
+			t.Errorf("read %q, expected %q", buf.Data, fmt.Sprint(7+i))
+		}
+
+		if buf.Lost != lost {
+			t.Errorf("block %d: Lost was %d, expected %d", 7+i, buf.Lost, lost)
+		}
+
+		if err := rw.SendReadBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blocks written after the reader caught up are not
+	// counted as lost.
+	if _, err := rw.Write([]byte("10")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.SendReadBuffer(buf)
+
+	if buf.Lost != 0 {
+		t.Errorf("Lost was %d, expected 0", buf.Lost)
+	}
+}
+
+// TestOverwriteHeld checks that a block taken by a
+// reader is never overwritten, the writer waits for it
+// instead.
+func TestOverwriteHeld(t *testing.T) {
+	rw, err := CreateSimplexWithOptions(testName(t), 0600, 4, 64, &CreateOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if _, err := rw.Write([]byte("held")); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := rw.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := rw.GetWriteBufferDeadline(time.Now().Add(10 * time.Millisecond)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("GetWriteBufferDeadline returned %v, expected %v", err, os.ErrDeadlineExceeded)
+	}
+
+	if string(held.Data) != "held" {
+		t.Errorf("held block was overwritten with %q", held.Data)
+	}
+
+	if err := rw.SendReadBuffer(held); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rw.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOverwriteOpen checks that a process opening
+// shared memory does not count blocks sent, and read,
+// before it was opened as lost.
+func TestOverwriteOpen(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplexWithOptions(name, 0600, 4, 64, &CreateOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	for i := 0; i < 5; i++ {
+		if _, err := rw.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := rw.Read(make([]byte, 64)); err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := rw.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := OpenSimplex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	buf, err := peer.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.SendReadBuffer(buf)
+
+	if buf.Lost != 0 {
+		t.Errorf("Lost was %d, expected 0", buf.Lost)
+	}
+}
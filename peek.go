@@ -0,0 +1,166 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// PeekReadBuffer returns the block that the next call
+// to GetReadBuffer would return, without taking it. It
+// waits for a block to be sent if none is readable.
+//
+// The returned Buffer must not be passed to
+// SendReadBuffer or RequeueReadBuffer, nor modified.
+// Its Data is only valid until the next call to a read
+// method of rw, and may change beneath the caller if
+// the block is taken by a reader in another process.
+//
+// It returns ErrInvalidSharedMemory if the size of the
+// block is larger than the block size.
+func (rw *ReadWriteCloser) PeekReadBuffer() (Buffer, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return Buffer{}, io.ErrClosedPipe
+	}
+
+	waited := false
+
+	for {
+		r := rw.acquire(&rw.read)
+		shared := r.shared
+
+		block, blockIndex, err := r.peek()
+		if err != nil {
+			r.seg.release()
+			return Buffer{}, err
+		}
+
+		if block != nil {
+			r.seg.release()
+
+			// The block is not held, so its size is only
+			// trusted as far as the block size.
+			size := atomic.LoadUint64((*uint64)(&block.Size))
+			if size > uint64(shared.BlockSize) {
+				return Buffer{}, ErrInvalidSharedMemory
+			}
+
+			if waited {
+				// The wake up was meant for a reader that
+				// would take the block, so pass it on.
+				if err := ((*semaphore)(&shared.SemSignal)).Post(); err != nil {
+					return Buffer{}, err
+				}
+			}
+
+			data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+			flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+			return Buffer{
+				index: blockIndex,
+
+				Data:  data[:size:size],
+				Flags: flags,
+
+				PublishedAt: int64(block.PublishedAt),
+			}, nil
+		}
+
+		readStart := atomic.LoadUint32((*uint32)(&shared.ReadStart))
+		if readStart == atomic.LoadUint32((*uint32)(&shared.WriteEnd)) && r.drained(readStart) {
+			// Wake the next waiting reader so that it
+			// too moves on to the next generation.
+			err := ((*semaphore)(&shared.SemSignal)).Post()
+			r.seg.release()
+
+			if err == nil {
+				err = rw.advance(&rw.read, r)
+			}
+
+			if err != nil {
+				return Buffer{}, err
+			}
+
+			continue
+		}
+
+		atomic.AddUint64((*uint64)(&shared.ReadWaits), 1)
+
+		waitStart := time.Now()
+		err = ((*semaphore)(&shared.SemSignal)).Wait(func() bool {
+			return atomic.LoadUint32((*uint32)(&shared.ReadStart)) != readStart ||
+				atomic.LoadUint32((*uint32)(&shared.WriteEnd)) != readStart
+		})
+		recordWait((*uint64)(&shared.ReadWaitNanos), (*[waitBuckets]uint64)(&shared.ReadWaitHist), time.Since(waitStart))
+
+		r.seg.release()
+
+		if err != nil {
+			return Buffer{}, err
+		}
+
+		waited = true
+	}
+}
+
+// peek returns the block that would next be taken by a
+// reader, or nil if there is none. Blocks abandoned by
+// a writer are passed over.
+func (r *ring) peek() (*sharedBlock, uint32, error) {
+	shared := r.shared
+	blockCount := uint32(shared.BlockCount)
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+
+	blockAt := func(index uint32) *sharedBlock {
+		return (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(index)*r.fullBlockSize)))
+	}
+
+	if top := uint32(atomic.LoadUint64((*uint64)(&shared.Requeued))); top != 0 {
+		if top > blockCount {
+			return nil, 0, ErrInvalidSharedMemory
+		}
+
+		return blockAt(top - 1), top - 1, nil
+	}
+
+	index := atomic.LoadUint32((*uint32)(&shared.ReadStart))
+	writeEnd := atomic.LoadUint32((*uint32)(&shared.WriteEnd))
+
+	for i := uint32(0); i < blockCount && index != writeEnd; i++ {
+		if index >= blockCount {
+			return nil, 0, ErrInvalidSharedMemory
+		}
+
+		block := blockAt(index)
+		if block.Flags[abortedFlagIndex]&abortedFlagMask == 0 {
+			return block, index, nil
+		}
+
+		index = uint32(block.Next)
+	}
+
+	return nil, 0, nil
+}
+
+// Skip takes and releases the next n blocks without
+// copying them. Like GetReadBuffer, it waits for
+// blocks to be sent.
+func (rw *ReadWriteCloser) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		buf, err := rw.GetReadBuffer()
+		if err != nil {
+			return err
+		}
+
+		if err = rw.SendReadBuffer(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// TestPeekReadBuffer checks that PeekReadBuffer returns
+// the block the next read takes, without taking it, and
+// passes over aborted blocks.
+func TestPeekReadBuffer(t *testing.T) {
+	rw := createRing(t, 8, 64)
+
+	buf, err := rw.GetWriteBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.AbortWriteBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAll(t, rw, "a", "b")
+
+	for i := 0; i < 2; i++ {
+		peek, err := rw.PeekReadBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(peek.Data) != "a" || cap(peek.Data) != 1 {
+			t.Fatalf("PeekReadBuffer returned %q, cap %d, expected %q, cap 1", peek.Data, cap(peek.Data), "a")
+		}
+	}
+
+	if received := rw.Stats().Read.BlocksReceived; received != 0 {
+		t.Errorf("Stats returned %d received after PeekReadBuffer, expected 0", received)
+	}
+
+	expectRead(t, rw, "a")
+
+	// A requeued block is peeked ahead of later blocks.
+	b, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeAll(t, rw, "c")
+
+	if _, err := rw.GetReadBuffer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.RequeueReadBuffer(b); err != nil {
+		t.Fatal(err)
+	}
+
+	peek, err := rw.PeekReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(peek.Data) != "b" {
+		t.Errorf("PeekReadBuffer returned %q, expected %q", peek.Data, "b")
+	}
+}
+
+// TestPeekReadBufferWaits checks that PeekReadBuffer
+// waits for a block to be sent.
+func TestPeekReadBufferWaits(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	done := make(chan string, 1)
+	go func() {
+		peek, err := rw.PeekReadBuffer()
+		if err != nil {
+			t.Error(err)
+		}
+
+		done <- string(peek.Data)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	writeAll(t, rw, "a")
+
+	select {
+	case got := <-done:
+		if got != "a" {
+			t.Errorf("PeekReadBuffer returned %q, expected %q", got, "a")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PeekReadBuffer did not return after a block was sent")
+	}
+
+	expectRead(t, rw, "a")
+}
+
+// TestPeekReadBufferInvalidSize checks that a block
+// whose size exceeds the block size is rejected rather
+// than exposing the memory beyond it.
+func TestPeekReadBufferInvalidSize(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	writeAll(t, rw, "a")
+
+	block, _, err := rw.root.rings[0].peek()
+	if err != nil || block == nil {
+		t.Fatalf("peek returned %v, %v", block, err)
+	}
+
+	*(*uint64)(&block.Size) = 65
+
+	if _, err := rw.PeekReadBuffer(); err != ErrInvalidSharedMemory {
+		t.Errorf("PeekReadBuffer returned %v, expected %v", err, ErrInvalidSharedMemory)
+	}
+
+	rw.Close()
+
+	if _, err := rw.PeekReadBuffer(); err != io.ErrClosedPipe {
+		t.Errorf("PeekReadBuffer returned %v after Close, expected %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestSkip checks that Skip discards exactly n blocks,
+// waiting for them to be sent.
+func TestSkip(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	writeAll(t, rw, "a", "b")
+
+	if err := rw.Skip(0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- rw.Skip(3)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	writeAll(t, rw, "c", "d")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expectRead(t, rw, "d")
+
+	if received := rw.Stats().Read.BlocksReceived; received != 4 {
+		t.Errorf("Stats returned %d received, expected 4", received)
+	}
+}
@@ -6,12 +6,15 @@
 package shm
 
 import (
+	"context"
+	"errors"
 	"golang.org/x/sys/unix"
 	"io"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
-
-	"github.com/tmthrgd/go-sem"
 )
 
 const (
@@ -19,29 +22,122 @@ const (
 	eofFlagMask  = 0x01
 )
 
+// errStopped is returned by getReadBuffer and
+// getWriteBuffer once done is closed.
+var errStopped = errors.New("shm: wait was stopped")
+
 type Buffer struct {
+	ring  *ring
 	block *sharedBlock
+	index uint32
 	write bool
 
-	Data  []byte
+	// seq is the sequence number of the block within a
+	// broadcast ring.
+	seq uint64
+
+	acquired time.Time
+
+	Data []byte
+
+	// Flags holds the flags of the block. Flags[0] is
+	// used by this package, the remaining bytes are free
+	// for applications. Since layout version 4 there are
+	// 24 bytes, there were 40 before.
 	Flags *[blockFlagsSize]byte
+
+	// PublishedAt is the CLOCK_MONOTONIC time, in
+	// nanoseconds, at which the block was sent. It is
+	// only set on read buffers when the shared memory
+	// was created with CreateOptions.Timestamps.
+	//
+	// As the clock is shared by every process on the
+	// host, Monotonic()-PublishedAt is the latency
+	// between the writer and the reader.
+	PublishedAt int64
+
+	// Lost is the number of blocks that were overwritten
+	// before they could be read, since the previous
+	// block read by this ReadWriteCloser. It is only set
+	// on read buffers when the shared memory was created
+	// with CreateOptions.Overwrite.
+	Lost int
 }
 
 type ReadWriteCloser struct {
 	name string
 
-	data          []byte
-	readShared    *sharedMem
-	writeShared   *sharedMem
-	size          uint64
-	fullBlockSize uint64
+	root    *segment
+	creator bool
+
+	// read and write hold the *ring currently used in
+	// each direction, they only change when the shared
+	// memory is resized.
+	//
+	// Must be accessed using atomic operations
+	read, write unsafe.Pointer
+
+	// resize guards moving between generations.
+	resize sync.Mutex
+
+	// latest is the last generation seen at Close.
+	latest uint32
+
+	metadata   []byte
+	timestamps bool
+	overwrite  bool
+
+	// readSeq is the sequence number of the block
+	// expected next by GetReadBuffer, it is used to count
+	// overwritten blocks.
+	//
+	// Must be accessed using atomic operations
+	readSeq uint32
 
 	// Must be accessed using atomic operations
 	Flags *[sharedFlagsSize]uint32
 
+	tracer Tracer
+
+	// mapping is held for reading by methods that read
+	// the shared memory without a Buffer, such as Stats,
+	// so that Close cannot unmap it beneath them.
+	mapping sync.RWMutex
+
 	closed uint32
 }
 
+func newReadWriteCloser(name string, root *segment, creator bool) *ReadWriteCloser {
+	read, write := root.ringsFor(creator)
+	shared := root.rings[0].shared
+
+	// Blocks sent before the shared memory was opened,
+	// and since released, were not lost by this
+	// process.
+	blockCount := uint32(read.shared.BlockCount)
+	readStart := atomic.LoadUint32((*uint32)(&read.shared.ReadStart))
+	writeEnd := atomic.LoadUint32((*uint32)(&read.shared.WriteEnd))
+	readSeq := atomic.LoadUint32((*uint32)(&read.shared.WriteSeq)) - (writeEnd+blockCount-readStart)%blockCount
+
+	return &ReadWriteCloser{
+		name: name,
+
+		root:    root,
+		creator: creator,
+
+		read:  unsafe.Pointer(read),
+		write: unsafe.Pointer(write),
+
+		metadata:   root.metadata,
+		timestamps: root.features&featureTimestamps != 0,
+		overwrite:  root.incompat&incompatOverwrite != 0,
+
+		readSeq: readSeq,
+
+		Flags: (*[len(shared.Flags)]uint32)(unsafe.Pointer(&shared.Flags[0])),
+	}
+}
+
 func (rw *ReadWriteCloser) Close() error {
 	if !atomic.CompareAndSwapUint32(&rw.closed, 0, 1) {
 		return nil
@@ -49,7 +145,21 @@ func (rw *ReadWriteCloser) Close() error {
 
 	// finish all sends before close!
 
-	return unix.Munmap(rw.data)
+	rw.mapping.Lock()
+	defer rw.mapping.Unlock()
+
+	rw.resize.Lock()
+	rw.latest = atomic.LoadUint32((*uint32)(&rw.root.rings[0].shared.LatestGeneration))
+
+	for s := rw.root.next; s != nil; s = s.next {
+		if atomic.SwapInt32(&s.refs, 0) > 0 {
+			unix.Munmap(s.data)
+		}
+	}
+
+	rw.resize.Unlock()
+
+	return unix.Munmap(rw.root.data)
 }
 
 // Name returns the name of the shared memory.
@@ -57,6 +167,19 @@ func (rw *ReadWriteCloser) Name() string {
 	return rw.name
 }
 
+// Metadata returns a copy of the application-defined
+// metadata that was passed in CreateOptions when the
+// shared memory was created.
+//
+// It returns nil if no metadata was set.
+func (rw *ReadWriteCloser) Metadata() []byte {
+	if len(rw.metadata) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), rw.metadata...)
+}
+
 // Unlink removes the shared memory.
 //
 // It is the equivalent to calling Unlink(string) with
@@ -69,8 +192,17 @@ func (rw *ReadWriteCloser) Name() string {
 // 	region.  After a successful shm_unlink(),  attempts  to  shm_open()  an
 // 	object  with  the same name will fail (unless O_CREAT was specified, in
 // 	which case a new, distinct object is created).
+//
+// For resizable shared memory, every later generation
+// is also removed.
 func (rw *ReadWriteCloser) Unlink() error {
-	return Unlink(rw.name)
+	err := Unlink(rw.name)
+
+	for gen, latest := 1, rw.Generation(); gen <= latest; gen++ {
+		Unlink(generationName(rw.name, uint32(gen)))
+	}
+
+	return err
 }
 
 // Read
@@ -118,43 +250,208 @@ func (rw *ReadWriteCloser) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (rw *ReadWriteCloser) GetReadBuffer() (Buffer, error) {
+	return rw.getReadBuffer(time.Time{}, nil)
+}
+
+// GetReadBufferDeadline is like GetReadBuffer but gives
+// up waiting for a block to be sent once deadline has
+// passed, returning os.ErrDeadlineExceeded. A zero
+// deadline waits forever.
+//
+// The deadline bounds only the wait for a block. A
+// block that is ready is returned even if the deadline
+// has passed. The wait is a timed futex wait, so it
+// costs nothing while no block is sent. As with
+// GetReadBuffer, the wait is counted in Stats and
+// reported to the Tracer.
+//
+// It allows a blocked reader to be stopped, such as by
+// a connection whose peer has exited, without closing
+// the shared memory from under it.
+func (rw *ReadWriteCloser) GetReadBufferDeadline(deadline time.Time) (Buffer, error) {
+	return rw.getReadBuffer(deadline, nil)
+}
+
+// GetReadBufferContext is like GetReadBufferDeadline,
+// with the deadline of ctx, but also gives up waiting
+// once ctx is done, returning ctx.Err().
+//
+// The wait is woken as soon as ctx is done, so that a
+// connection may stop a blocked reader when it is
+// closed or its deadline is changed.
+func (rw *ReadWriteCloser) GetReadBufferContext(ctx context.Context) (Buffer, error) {
+	deadline, _ := ctx.Deadline()
+	buf, err := rw.getReadBuffer(deadline, ctx.Done())
+	return buf, contextError(ctx, err)
+}
+
+// contextError returns the error of ctx in place of
+// errStopped and os.ErrDeadlineExceeded.
+func contextError(ctx context.Context, err error) error {
+	switch err {
+	case errStopped:
+		return ctx.Err()
+	case os.ErrDeadlineExceeded:
+		return context.DeadlineExceeded
+	default:
+		return err
+	}
+}
+
+func (rw *ReadWriteCloser) getReadBuffer(deadline time.Time, done <-chan struct{}) (Buffer, error) {
 	if atomic.LoadUint32(&rw.closed) != 0 {
 		return Buffer{}, io.ErrClosedPipe
 	}
 
-	var block *sharedBlock
+	var start time.Time
+	if rw.tracer != nil {
+		start = time.Now()
+	}
 
-	blocks := uintptr(unsafe.Pointer(rw.readShared)) + sharedHeaderSize
+	var (
+		r          *ring
+		shared     *sharedMem
+		block      *sharedBlock
+		blockIndex uint32
+	)
 
 	for {
-		blockIndex := atomic.LoadUint32((*uint32)(&rw.readShared.ReadStart))
-		if blockIndex > uint32(rw.readShared.BlockCount) {
+		r = rw.acquire(&rw.read)
+		shared = r.shared
+
+		// Blocks handed back by RequeueReadBuffer are
+		// taken before any other.
+		if block, blockIndex = r.popRequeued(); block != nil {
+			atomic.StoreUint32((*uint32)(&block.Owner), ownerPID|readOwnerBit)
+			break
+		}
+
+		blockIndex = atomic.LoadUint32((*uint32)(&shared.ReadStart))
+		if blockIndex > uint32(shared.BlockCount) {
+			r.seg.release()
 			return Buffer{}, ErrInvalidSharedMemory
 		}
 
-		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+		blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*r.fullBlockSize)))
+
+		if blockIndex == atomic.LoadUint32((*uint32)(&shared.WriteEnd)) {
+			if r.drained(blockIndex) {
+				// Wake the next waiting reader so that it
+				// too moves on to the next generation.
+				err := ((*semaphore)(&shared.SemSignal)).Post()
+				r.seg.release()
+
+				if err == nil {
+					err = rw.advance(&rw.read, r)
+				}
+
+				if err != nil {
+					return Buffer{}, err
+				}
+
+				continue
+			}
+
+			atomic.AddUint64((*uint64)(&shared.ReadWaits), 1)
+
+			waitStart := time.Now()
+			if rw.tracer != nil {
+				rw.tracer.WaitStarted(WaitEvent{Block: int(blockIndex), Start: waitStart})
+			}
+
+			sem := (*semaphore)(&shared.SemSignal)
+			stop := sem.wakeOn(done)
+
+			readStart := blockIndex
+			err := sem.WaitDeadline(deadline, func() bool {
+				return atomic.LoadUint32((*uint32)(&shared.ReadStart)) != readStart ||
+					atomic.LoadUint32((*uint32)(&shared.WriteEnd)) != readStart ||
+					stopped(done)
+			})
+			stop()
+
+			waited := time.Since(waitStart)
+			recordWait((*uint64)(&shared.ReadWaitNanos), (*[waitBuckets]uint64)(&shared.ReadWaitHist), waited)
+
+			if rw.tracer != nil {
+				rw.tracer.WaitFinished(WaitEvent{Block: int(blockIndex), Start: waitStart, Duration: waited})
+			}
+
+			r.seg.release()
 
-		if blockIndex == atomic.LoadUint32((*uint32)(&rw.readShared.WriteEnd)) {
-			if err := ((*sem.Semaphore)(&rw.readShared.SemSignal)).Wait(); err != nil {
+			if err == nil && stopped(done) {
+				err = errStopped
+			}
+
+			if err != nil {
 				return Buffer{}, err
 			}
 
 			continue
 		}
 
-		if atomic.CompareAndSwapUint32((*uint32)(&rw.readShared.ReadStart), blockIndex, uint32(block.Next)) {
+		if !atomic.CompareAndSwapUint32((*uint32)(&shared.ReadStart), blockIndex, uint32(block.Next)) {
+			r.seg.release()
+			continue
+		}
+
+		// Each block sent wakes at most one reader, so pass
+		// the wake up on while blocks remain to be read. The
+		// block has been claimed, so a failure to wake
+		// another reader is not returned.
+		if sem := (*semaphore)(&shared.SemSignal); sem.Waiting() && uint32(block.Next) != atomic.LoadUint32((*uint32)(&shared.WriteEnd)) {
+			sem.Post()
+		}
+
+		if block.Flags[abortedFlagIndex]&abortedFlagMask == 0 {
+			atomic.StoreUint32((*uint32)(&block.Owner), ownerPID|readOwnerBit)
 			break
 		}
+
+		// The block was abandoned by a writer and must
+		// not be seen by readers.
+		if rw.overwrite {
+			rw.countLost(atomic.LoadUint32((*uint32)(&block.Seq)))
+		}
+
+		err := r.releaseRead(block)
+		r.seg.release()
+
+		if err != nil {
+			return Buffer{}, err
+		}
 	}
 
 	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
 	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
-	return Buffer{
+	buf := Buffer{
+		ring:  r,
 		block: block,
+		index: blockIndex,
 
-		Data:  data[:block.Size:rw.readShared.BlockSize],
+		Data:  data[:block.Size:shared.BlockSize],
 		Flags: flags,
-	}, nil
+
+		PublishedAt: int64(block.PublishedAt),
+	}
+
+	if rw.overwrite {
+		buf.Lost = rw.countLost(atomic.LoadUint32((*uint32)(&block.Seq)))
+	}
+
+	if rw.tracer != nil {
+		buf.acquired = time.Now()
+		rw.tracer.ReadAcquired(TraceEvent{
+			Block: int(blockIndex),
+			Size:  len(buf.Data),
+
+			Start:    start,
+			Duration: buf.acquired.Sub(start),
+		})
+	}
+
+	return buf, nil
 }
 
 func (rw *ReadWriteCloser) SendReadBuffer(buf Buffer) error {
@@ -162,32 +459,87 @@ func (rw *ReadWriteCloser) SendReadBuffer(buf Buffer) error {
 		return io.ErrClosedPipe
 	}
 
-	if buf.write {
+	if buf.write || buf.ring == nil {
 		return ErrInvalidBuffer
 	}
 
-	block := buf.block
+	defer buf.ring.seg.release()
 
+	var start time.Time
+	if rw.tracer != nil {
+		start = time.Now()
+	}
+
+	shared := buf.ring.shared
+	size := uint64(buf.block.Size)
+
+	atomic.AddUint64((*uint64)(&shared.BlocksReceived), 1)
+	atomic.AddUint64((*uint64)(&shared.BytesReceived), size)
+
+	err := buf.ring.releaseRead(buf.block)
+
+	if rw.tracer != nil {
+		now := time.Now()
+		rw.tracer.ReadReleased(TraceEvent{
+			Block: int(buf.index),
+			Size:  int(size),
+
+			Start:    start,
+			Duration: now.Sub(start),
+
+			Held: start.Sub(buf.acquired),
+		})
+	}
+
+	return err
+}
+
+// countLost returns the number of blocks overwritten
+// between the last block read and the block numbered
+// seq. Blocks may be read out of order by concurrent
+// readers, those are not counted.
+func (rw *ReadWriteCloser) countLost(seq uint32) int {
+	for {
+		expected := atomic.LoadUint32(&rw.readSeq)
+
+		lost := seq - expected
+		if lost >= 1<<31 {
+			return 0
+		}
+
+		if atomic.CompareAndSwapUint32(&rw.readSeq, expected, seq+1) {
+			return int(lost)
+		}
+	}
+}
+
+// releaseRead marks block as read and moves ReadEnd
+// past every block that has been read, waking a
+// writer if the ring was full.
+func (r *ring) releaseRead(block *sharedBlock) error {
+	shared := r.shared
+
+	atomic.StoreUint32((*uint32)(&block.Owner), 0)
 	atomic.StoreUint32((*uint32)(&block.DoneRead), 1)
 
-	blocks := uintptr(unsafe.Pointer(rw.readShared)) + sharedHeaderSize
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
 
 	for {
-		blockIndex := atomic.LoadUint32((*uint32)(&rw.readShared.ReadEnd))
-		if blockIndex > uint32(rw.readShared.BlockCount) {
+		blockIndex := atomic.LoadUint32((*uint32)(&shared.ReadEnd))
+		if blockIndex > uint32(shared.BlockCount) {
 			return ErrInvalidSharedMemory
 		}
 
-		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*r.fullBlockSize)))
 
 		if !atomic.CompareAndSwapUint32((*uint32)(&block.DoneRead), 1, 0) {
 			return nil
 		}
 
-		atomic.CompareAndSwapUint32((*uint32)(&rw.readShared.ReadEnd), blockIndex, uint32(block.Next))
+		atomic.CompareAndSwapUint32((*uint32)(&shared.ReadEnd), blockIndex, uint32(block.Next))
 
-		if uint32(block.Prev) == atomic.LoadUint32((*uint32)(&rw.readShared.WriteStart)) {
-			if err := ((*sem.Semaphore)(&rw.readShared.SemAvail)).Post(); err != nil {
+		if uint32(block.Prev) == atomic.LoadUint32((*uint32)(&shared.WriteStart)) {
+			if err := ((*semaphore)(&shared.SemAvail)).Post(); err != nil {
 				return err
 			}
 		}
@@ -241,44 +593,189 @@ func (rw *ReadWriteCloser) ReadFrom(r io.Reader) (n int64, err error) {
 }
 
 func (rw *ReadWriteCloser) GetWriteBuffer() (Buffer, error) {
+	return rw.getWriteBuffer(time.Time{}, nil)
+}
+
+// GetWriteBufferDeadline is like GetWriteBuffer but
+// gives up waiting for a block to be freed once
+// deadline has passed, returning os.ErrDeadlineExceeded.
+// A zero deadline waits forever.
+//
+// As with GetReadBufferDeadline, the deadline bounds
+// only the wait, which is counted in Stats and reported
+// to the Tracer.
+func (rw *ReadWriteCloser) GetWriteBufferDeadline(deadline time.Time) (Buffer, error) {
+	return rw.getWriteBuffer(deadline, nil)
+}
+
+// GetWriteBufferContext is like GetWriteBufferDeadline,
+// with the deadline of ctx, but also gives up waiting
+// once ctx is done, returning ctx.Err(). See
+// GetReadBufferContext.
+func (rw *ReadWriteCloser) GetWriteBufferContext(ctx context.Context) (Buffer, error) {
+	deadline, _ := ctx.Deadline()
+	buf, err := rw.getWriteBuffer(deadline, ctx.Done())
+	return buf, contextError(ctx, err)
+}
+
+func (rw *ReadWriteCloser) getWriteBuffer(deadline time.Time, done <-chan struct{}) (Buffer, error) {
 	if atomic.LoadUint32(&rw.closed) != 0 {
 		return Buffer{}, io.ErrClosedPipe
 	}
 
-	var block *sharedBlock
+	var start time.Time
+	if rw.tracer != nil {
+		start = time.Now()
+	}
 
-	blocks := uintptr(unsafe.Pointer(rw.writeShared)) + sharedHeaderSize
+	var (
+		r          *ring
+		shared     *sharedMem
+		block      *sharedBlock
+		blockIndex uint32
+	)
 
 	for {
-		blockIndex := atomic.LoadUint32((*uint32)(&rw.writeShared.WriteStart))
-		if blockIndex > uint32(rw.writeShared.BlockCount) {
+		r = rw.acquire(&rw.write)
+		shared = r.shared
+
+		blockIndex = atomic.LoadUint32((*uint32)(&shared.WriteStart))
+		if blockIndex&sealedBit != 0 {
+			// Wake the next waiting writer so that it
+			// too moves on to the next generation.
+			err := ((*semaphore)(&shared.SemAvail)).Post()
+			r.seg.release()
+
+			if err == nil {
+				err = rw.advance(&rw.write, r)
+			}
+
+			if err != nil {
+				return Buffer{}, err
+			}
+
+			continue
+		}
+
+		if blockIndex > uint32(shared.BlockCount) {
+			r.seg.release()
 			return Buffer{}, ErrInvalidSharedMemory
 		}
 
-		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+		blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*r.fullBlockSize)))
+
+		if uint32(block.Next) == atomic.LoadUint32((*uint32)(&shared.ReadEnd)) {
+			if rw.overwrite {
+				discarded, err := r.discardOldest()
+				if discarded || err != nil {
+					r.seg.release()
+
+					if err != nil {
+						return Buffer{}, err
+					}
+
+					continue
+				}
+			}
+
+			atomic.AddUint64((*uint64)(&shared.WriteWaits), 1)
+
+			waitStart := time.Now()
+			if rw.tracer != nil {
+				rw.tracer.WaitStarted(WaitEvent{Write: true, Block: int(blockIndex), Start: waitStart})
+			}
+
+			sem := (*semaphore)(&shared.SemAvail)
+			stop := sem.wakeOn(done)
+
+			writeStart, next := blockIndex, uint32(block.Next)
+			err := sem.WaitDeadline(deadline, func() bool {
+				return atomic.LoadUint32((*uint32)(&shared.WriteStart)) != writeStart ||
+					atomic.LoadUint32((*uint32)(&shared.ReadEnd)) != next ||
+					stopped(done)
+			})
+			stop()
+
+			waited := time.Since(waitStart)
+			recordWait((*uint64)(&shared.WriteWaitNanos), (*[waitBuckets]uint64)(&shared.WriteWaitHist), waited)
+
+			if rw.tracer != nil {
+				rw.tracer.WaitFinished(WaitEvent{Write: true, Block: int(blockIndex), Start: waitStart, Duration: waited})
+			}
+
+			r.seg.release()
+
+			if err == nil && stopped(done) {
+				err = errStopped
+			}
 
-		if uint32(block.Next) == atomic.LoadUint32((*uint32)(&rw.writeShared.ReadEnd)) {
-			if err := ((*sem.Semaphore)(&rw.writeShared.SemAvail)).Wait(); err != nil {
+			if err != nil {
 				return Buffer{}, err
 			}
 
 			continue
 		}
 
-		if atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteStart), blockIndex, uint32(block.Next)) {
+		if atomic.CompareAndSwapUint32((*uint32)(&shared.WriteStart), blockIndex, uint32(block.Next)) {
 			break
 		}
+
+		r.seg.release()
+	}
+
+	// Only a reader that frees a block in a full ring
+	// wakes a writer, so pass the wake up on while blocks
+	// remain free. As above, a failure is not returned.
+	if sem := (*semaphore)(&shared.SemAvail); sem.Waiting() {
+		blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+		next := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(block.Next)*r.fullBlockSize)))
+
+		if uint32(next.Next) != atomic.LoadUint32((*uint32)(&shared.ReadEnd)) {
+			sem.Post()
+		}
+	}
+
+	atomic.StoreUint32((*uint32)(&block.Owner), ownerPID)
+
+	// Flags are otherwise left as the last writer of the
+	// block set them, but those used internally must not
+	// carry over.
+	block.Flags[abortedFlagIndex] &^= abortedFlagMask
+	block.Flags[payloadFlagIndex] &^= payloadFlagMask
+	block.Flags[moreFlagIndex] &^= moreFlagMask
+	block.Flags[cancelFlagIndex] &^= cancelFlagMask
+
+	if !rw.root.duplex && atomic.LoadPointer(&rw.read) != unsafe.Pointer(r) {
+		// A process that only writes never calls
+		// GetReadBuffer, so would otherwise keep every
+		// earlier generation mapped.
+		rw.advanceDrainedRead()
 	}
 
 	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
 	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
-	return Buffer{
+	buf := Buffer{
+		ring:  r,
 		block: block,
+		index: blockIndex,
 		write: true,
 
-		Data:  data[:0:rw.writeShared.BlockSize],
+		Data:  data[:0:shared.BlockSize],
 		Flags: flags,
-	}, nil
+	}
+
+	if rw.tracer != nil {
+		buf.acquired = time.Now()
+		rw.tracer.WriteAcquired(TraceEvent{
+			Block: int(blockIndex),
+
+			Start:    start,
+			Duration: buf.acquired.Sub(start),
+		})
+	}
+
+	return buf, nil
 }
 
 func (rw *ReadWriteCloser) SendWriteBuffer(buf Buffer) (n int, err error) {
@@ -286,36 +783,128 @@ func (rw *ReadWriteCloser) SendWriteBuffer(buf Buffer) (n int, err error) {
 		return 0, io.ErrClosedPipe
 	}
 
-	if !buf.write {
+	if !buf.write || buf.ring == nil {
 		return 0, ErrInvalidBuffer
 	}
 
+	defer buf.ring.seg.release()
+
+	var start time.Time
+	if rw.tracer != nil {
+		start = time.Now()
+	}
+
+	shared := buf.ring.shared
 	block := buf.block
 
 	*(*uint64)(&block.Size) = uint64(len(buf.Data))
 
+	if rw.timestamps {
+		*(*uint64)(&block.PublishedAt) = uint64(Monotonic())
+	}
+
+	atomic.AddUint64((*uint64)(&shared.BlocksSent), 1)
+	atomic.AddUint64((*uint64)(&shared.BytesSent), uint64(len(buf.Data)))
+
+	err = buf.ring.publishWrite(block)
+
+	if rw.tracer != nil {
+		now := time.Now()
+		rw.tracer.WritePublished(TraceEvent{
+			Block: int(buf.index),
+			Size:  len(buf.Data),
+
+			Start:    start,
+			Duration: now.Sub(start),
+
+			Held: start.Sub(buf.acquired),
+		})
+	}
+
+	return len(buf.Data), err
+}
+
+// publishWrite marks block as written and moves
+// WriteEnd past every block that has been written,
+// waking a reader if the ring was empty.
+func (r *ring) publishWrite(block *sharedBlock) error {
+	shared := r.shared
+
+	atomic.StoreUint32((*uint32)(&block.Owner), 0)
 	atomic.StoreUint32((*uint32)(&block.DoneWrite), 1)
 
-	blocks := uintptr(unsafe.Pointer(rw.writeShared)) + sharedHeaderSize
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
 
 	for {
-		blockIndex := atomic.LoadUint32((*uint32)(&rw.writeShared.WriteEnd))
-		if blockIndex > uint32(rw.writeShared.BlockCount) {
-			return len(buf.Data), ErrInvalidSharedMemory
+		blockIndex := atomic.LoadUint32((*uint32)(&shared.WriteEnd))
+		if blockIndex > uint32(shared.BlockCount) {
+			return ErrInvalidSharedMemory
 		}
 
-		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*r.fullBlockSize)))
 
 		if !atomic.CompareAndSwapUint32((*uint32)(&block.DoneWrite), 1, 0) {
-			return len(buf.Data), nil
+			return nil
 		}
 
-		atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteEnd), blockIndex, uint32(block.Next))
+		// Only the writer that cleared DoneWrite may move
+		// WriteEnd past the block, so blocks are numbered
+		// in the order they are published.
+		seq := atomic.LoadUint32((*uint32)(&shared.WriteSeq))
+		atomic.StoreUint32((*uint32)(&block.Seq), seq)
+		atomic.StoreUint32((*uint32)(&shared.WriteSeq), seq+1)
+
+		atomic.CompareAndSwapUint32((*uint32)(&shared.WriteEnd), blockIndex, uint32(block.Next))
 
-		if blockIndex == atomic.LoadUint32((*uint32)(&rw.writeShared.ReadStart)) {
-			if err := ((*sem.Semaphore)(&rw.writeShared.SemSignal)).Post(); err != nil {
-				return len(buf.Data), err
+		if blockIndex == atomic.LoadUint32((*uint32)(&shared.ReadStart)) {
+			if err := ((*semaphore)(&shared.SemSignal)).Post(); err != nil {
+				return err
 			}
 		}
 	}
 }
+
+// discardOldest takes the oldest unread block, as a
+// reader would, and releases it unread so that a
+// writer may overwrite it. It only does so if the
+// block is the next to be released, otherwise a reader
+// holds an earlier block and the writer must wait.
+//
+// It reports whether the ring changed and the caller
+// should look again before waiting.
+func (r *ring) discardOldest() (bool, error) {
+	shared := r.shared
+
+	blockIndex := atomic.LoadUint32((*uint32)(&shared.ReadStart))
+	if blockIndex != atomic.LoadUint32((*uint32)(&shared.ReadEnd)) ||
+		blockIndex == atomic.LoadUint32((*uint32)(&shared.WriteEnd)) {
+		return false, nil
+	}
+
+	if blockIndex > uint32(shared.BlockCount) {
+		return false, ErrInvalidSharedMemory
+	}
+
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+	block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*r.fullBlockSize)))
+
+	if !atomic.CompareAndSwapUint32((*uint32)(&shared.ReadStart), blockIndex, uint32(block.Next)) {
+		// A reader took it first.
+		return true, nil
+	}
+
+	atomic.AddUint64((*uint64)(&shared.BlocksOverwritten), 1)
+	return true, r.releaseRead(block)
+}
+
+// Monotonic returns the current CLOCK_MONOTONIC time
+// in nanoseconds, for comparison with
+// Buffer.PublishedAt.
+func Monotonic() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		panic(err)
+	}
+
+	return ts.Nano()
+}
@@ -0,0 +1,372 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testName returns a shared memory name unique to the
+// test or benchmark t.
+func testName(t testing.TB) string {
+	return fmt.Sprintf("/shm-go-test-%s-%d", strings.Replace(t.Name(), "/", "-", -1), os.Getpid())
+}
+
+// startHelper runs TestHelperProcess in a child
+// process with args, and waits for it to report that it
+// is ready. The child is killed, without cleaning up,
+// when the test ends.
+func startHelper(t *testing.T, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "SHM_GO_TEST_HELPER=1")
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		t.Fatalf("helper %q failed: %q, %v", args, line, err)
+	}
+
+	return cmd
+}
+
+// TestHelperProcess is not a real test, it is run in a
+// child process by startHelper. It holds shared memory
+// in the way args describe until it is killed.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("SHM_GO_TEST_HELPER") == "" {
+		return
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "helper: bad arguments %q\n", args)
+		os.Exit(2)
+	}
+
+	var err error
+
+	switch name := args[2]; args[1] {
+	case "subscribe":
+		_, err = OpenSubscriber(name)
+	case "mailbox-hold":
+		// Take the seqlock as Store does, and never
+		// release it.
+		var m *Mailbox
+		if m, err = OpenMailbox(name); err == nil {
+			seq := atomic.LoadUint32((*uint32)(&m.block.Seq))
+			atomic.StoreUint32((*uint32)(&m.block.Seq), seq|1)
+			atomic.StoreUint32((*uint32)(&m.block.Owner), ownerPID)
+		}
+	case "hold-read", "hold-write":
+		// Take a block and never send or release it.
+		var rw *ReadWriteCloser
+		if rw, err = OpenSimplex(name); err == nil {
+			if args[1] == "hold-read" {
+				_, err = rw.GetReadBuffer()
+			} else {
+				_, err = rw.GetWriteBuffer()
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[1])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helper: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("ready")
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+// TestManyReadersWriters checks that a Post that wakes
+// one of several blocked readers or writers is passed on
+// while blocks remain, so that none is left waiting.
+func TestManyReadersWriters(t *testing.T) {
+	const (
+		writers = 8
+		readers = 8
+		perEach = 20000
+	)
+
+	name := testName(t)
+	rw, err := CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Unlink()
+
+	done := make(chan struct{})
+	counts := make(chan int, readers)
+
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				n := 0
+				for {
+					buf, err := rw.GetReadBuffer()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					stop := len(buf.Data) == 0
+					if err := rw.SendReadBuffer(buf); err != nil {
+						t.Error(err)
+						return
+					}
+
+					if stop {
+						counts <- n
+						return
+					}
+
+					n++
+				}
+			}()
+		}
+
+		var wwg sync.WaitGroup
+
+		for i := 0; i < writers; i++ {
+			wwg.Add(1)
+			go func() {
+				defer wwg.Done()
+
+				for j := 0; j < perEach; j++ {
+					if _, err := rw.Write([]byte{1}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+
+		wwg.Wait()
+
+		// An empty block stops each reader.
+		for i := 0; i < readers; i++ {
+			if _, err := rw.Write(nil); err != nil {
+				t.Error(err)
+			}
+		}
+
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		// The blocked goroutines still use the mapping,
+		// so it is not closed.
+		t.Fatal("readers and writers did not finish, a wake up was lost")
+	}
+
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(counts)
+
+	total := 0
+	for n := range counts {
+		total += n
+	}
+
+	if total != writers*perEach {
+		t.Fatalf("read %d blocks, wanted %d", total, writers*perEach)
+	}
+}
+
+// TestGetBufferDeadline checks that GetReadBufferDeadline
+// and GetWriteBufferDeadline give up once their deadline
+// has passed, and return a block that is ready.
+func TestGetBufferDeadline(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 2, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Unlink()
+	defer rw.Close()
+
+	const wait = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := rw.GetReadBufferDeadline(start.Add(wait)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("GetReadBufferDeadline on an empty ring returned %v", err)
+	}
+	if d := time.Since(start); d < wait {
+		t.Fatalf("GetReadBufferDeadline returned after %s, before its deadline", d)
+	}
+
+	for rw.Stats().Write.Writable > 0 {
+		buf, err := rw.GetWriteBufferDeadline(time.Now().Add(-time.Second))
+		if err != nil {
+			t.Fatalf("GetWriteBufferDeadline with a free block returned %v", err)
+		}
+
+		if _, err = rw.SendWriteBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start = time.Now()
+	if _, err := rw.GetWriteBufferDeadline(start.Add(wait)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("GetWriteBufferDeadline on a full ring returned %v", err)
+	}
+	if d := time.Since(start); d < wait {
+		t.Fatalf("GetWriteBufferDeadline returned after %s, before its deadline", d)
+	}
+
+	if _, err := rw.GetReadBufferDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("GetReadBufferDeadline with a sent block returned %v", err)
+	}
+}
+
+// TestCloseWhileReadingStats checks that Close waits for
+// methods that read the shared memory outside of a
+// Buffer, rather than unmap it beneath them.
+func TestCloseWhileReadingStats(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw.Unlink()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for {
+					rw.Generation()
+					rw.Recover()
+
+					if rw.Stats().Read.BlockCount == 0 {
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(100 * time.Microsecond)
+
+		if err := rw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Wait()
+	}
+}
+
+// TestGetBufferContext checks that a reader or writer
+// blocked in GetReadBufferContext or
+// GetWriteBufferContext returns as soon as its context
+// is cancelled, and that the deadline of the context
+// is honoured.
+func TestGetBufferContext(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 2, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := rw.GetReadBufferContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("GetReadBufferContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// The ring keeps one block empty, so one write
+	// fills it.
+	if _, err := rw.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, get := range []func(context.Context) (Buffer, error){
+		rw.GetWriteBufferContext,
+		func(ctx context.Context) (Buffer, error) {
+			// Empty the ring again first.
+			if err := rw.Skip(1); err != nil {
+				return Buffer{}, err
+			}
+
+			return rw.GetReadBufferContext(ctx)
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := get(ctx)
+			errc <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+
+		select {
+		case err := <-errc:
+			if err != context.Canceled {
+				t.Fatalf("returned %v, expected %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not return after the context was cancelled")
+		}
+	}
+
+	// A block that is ready is returned whatever the
+	// context.
+	if _, err := rw.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rw.GetReadBufferContext(ctx); err != nil {
+		t.Errorf("GetReadBufferContext returned %v with a block ready", err)
+	}
+}
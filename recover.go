@@ -0,0 +1,152 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	abortedFlagIndex = 0
+	abortedFlagMask  = 0x04
+
+	// readOwnerBit is set in the Owner of a block that
+	// has been taken by a reader, rather than a writer.
+	// Process IDs never reach it.
+	readOwnerBit = 1 << 31
+)
+
+// ownerPID is stored in the Owner of each block taken
+// by this process.
+var ownerPID = uint32(os.Getpid())
+
+// processAlive reports whether a process with the given
+// process ID exists.
+func processAlive(pid uint32) bool {
+	err := unix.Kill(int(pid), 0)
+	return err == nil || err == unix.EPERM
+}
+
+// Recover reclaims blocks that were taken by a process
+// that has since exited without sending or releasing
+// them. Such blocks otherwise stop WriteEnd or ReadEnd
+// from advancing, and so wedge the ring.
+//
+// Blocks abandoned by a writer are marked as aborted
+// and skipped by readers, they are counted by
+// RingStats.Aborted. Blocks abandoned by a reader are
+// released unread.
+//
+// Recover may be called at any time by any attached
+// process, such as one restarted in place of a process
+// that exited. It returns the number of blocks
+// reclaimed.
+//
+// Owners are judged by process ID alone. A process in
+// another PID namespace, such as another container
+// sharing /dev/shm, appears to have exited, and the
+// blocks it holds would be reclaimed from under it and
+// the ring corrupted. Recover must only be called when
+// every attached process shares a PID namespace, and so
+// it is never called by Open*.
+//
+// A process that exits between taking a block and
+// recording itself as the owner cannot be recovered
+// from.
+func (rw *ReadWriteCloser) Recover() (int, error) {
+	rw.mapping.RLock()
+	defer rw.mapping.RUnlock()
+
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+
+	read, write := rw.acquire(&rw.read), rw.acquire(&rw.write)
+	defer read.seg.release()
+	defer write.seg.release()
+
+	n, err := read.recover()
+	if err != nil || write == read {
+		return n, err
+	}
+
+	nn, err := write.recover()
+	return n + nn, err
+}
+
+func (r *ring) recover() (n int, err error) {
+	shared := r.shared
+	blockCount := uint32(shared.BlockCount)
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+
+	// walk calls fn for each block from start up to, but
+	// not including, end. Next is fixed when the shared
+	// memory is created, so the walk is safe even as the
+	// cursors move.
+	walk := func(start, end uint32, fn func(block *sharedBlock) error) error {
+		for i := uint32(0); i < blockCount && start != end; i++ {
+			if start >= blockCount {
+				return ErrInvalidSharedMemory
+			}
+
+			block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(start)*r.fullBlockSize)))
+			if err := fn(block); err != nil {
+				return err
+			}
+
+			start = uint32(block.Next)
+		}
+
+		return nil
+	}
+
+	// reclaim takes ownership of an abandoned block. The
+	// role bit guards against a block that has since
+	// been released and taken in the other direction.
+	reclaim := func(block *sharedBlock, role uint32) bool {
+		owner := atomic.LoadUint32((*uint32)(&block.Owner))
+		return owner != 0 && owner&readOwnerBit == role &&
+			!processAlive(owner&^readOwnerBit) &&
+			atomic.CompareAndSwapUint32((*uint32)(&block.Owner), owner, 0)
+	}
+
+	// Blocks taken by readers lie between ReadEnd and
+	// ReadStart.
+	err = walk(atomic.LoadUint32((*uint32)(&shared.ReadEnd)), atomic.LoadUint32((*uint32)(&shared.ReadStart)),
+		func(block *sharedBlock) error {
+			if !reclaim(block, readOwnerBit) {
+				return nil
+			}
+
+			n++
+			return r.releaseRead(block)
+		})
+	if err != nil {
+		return n, err
+	}
+
+	// Blocks taken by writers lie between WriteEnd and
+	// WriteStart.
+	err = walk(atomic.LoadUint32((*uint32)(&shared.WriteEnd)), atomic.LoadUint32((*uint32)(&shared.WriteStart))&^sealedBit,
+		func(block *sharedBlock) error {
+			if !reclaim(block, 0) {
+				return nil
+			}
+
+			*(*uint64)(&block.Size) = 0
+			block.Flags[abortedFlagIndex] |= abortedFlagMask
+
+			atomic.AddUint64((*uint64)(&shared.BlocksAborted), 1)
+
+			n++
+			return r.publishWrite(block)
+		})
+	return n, err
+}
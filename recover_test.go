@@ -0,0 +1,134 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// killHelper runs TestHelperProcess with command and
+// name, and kills it once it is holding its block.
+func killHelper(t *testing.T, command, name string) {
+	cmd := startHelper(t, command, name)
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Wait()
+}
+
+// TestRecoverWrite checks that a block abandoned by a
+// writer that exited wedges the ring until Recover
+// aborts it, and that later blocks are then read.
+func TestRecoverWrite(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	killHelper(t, "hold-write", name)
+
+	if _, err := rw.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rw.GetReadBufferDeadline(time.Now().Add(10 * time.Millisecond)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("GetReadBufferDeadline returned %v, expected %v", err, os.ErrDeadlineExceeded)
+	}
+
+	n, err := rw.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("Recover returned %d, expected 1", n)
+	}
+
+	p := make([]byte, 64)
+	if n, err := rw.Read(p); err != io.EOF || string(p[:n]) != "after" {
+		t.Fatalf("Read returned %q, %v, expected %q, %v", p[:n], err, "after", io.EOF)
+	}
+
+	if aborted := rw.Stats().Read.Aborted; aborted != 1 {
+		t.Errorf("Stats returned %d aborted, expected 1", aborted)
+	}
+
+	if n, err := rw.Recover(); n != 0 || err != nil {
+		t.Errorf("second Recover returned %d, %v, expected 0, <nil>", n, err)
+	}
+}
+
+// TestRecoverRead checks that a block abandoned by a
+// reader that exited is released by Recover, so that
+// writers may use it again.
+func TestRecoverRead(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 2, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if _, err := rw.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	killHelper(t, "hold-read", name)
+
+	// The ring keeps one block empty, so with the other
+	// held the writer has nowhere to write.
+	if _, err := rw.GetWriteBufferDeadline(time.Now().Add(10 * time.Millisecond)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("GetWriteBufferDeadline returned %v, expected %v", err, os.ErrDeadlineExceeded)
+	}
+
+	n, err := rw.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("Recover returned %d, expected 1", n)
+	}
+
+	if _, err := rw.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 64)
+	if n, err := rw.Read(p); err != io.EOF || string(p[:n]) != "after" {
+		t.Fatalf("Read returned %q, %v, expected %q, %v", p[:n], err, "after", io.EOF)
+	}
+}
+
+// TestRecoverLive checks that Recover leaves blocks
+// held by a live process alone.
+func TestRecoverLive(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	startHelper(t, "hold-write", name)
+
+	if n, err := rw.Recover(); n != 0 || err != nil {
+		t.Errorf("Recover returned %d, %v, expected 0, <nil>", n, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// requeuedBit is set in the DoneRead of a block that is
+// on the requeued stack, the remaining bits hold the
+// index plus one of the block below it. ReadEnd never
+// moves past such a block.
+const requeuedBit = 1 << 31
+
+// AbortWriteBuffer gives back a buffer taken by
+// GetWriteBuffer without sending it. The block is
+// skipped by readers, who never see it, and is counted
+// by RingStats.Aborted.
+func (rw *ReadWriteCloser) AbortWriteBuffer(buf Buffer) error {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if !buf.write || buf.ring == nil {
+		return ErrInvalidBuffer
+	}
+
+	defer buf.ring.seg.release()
+
+	block := buf.block
+
+	*(*uint64)(&block.Size) = 0
+	block.Flags[abortedFlagIndex] |= abortedFlagMask
+
+	atomic.AddUint64((*uint64)(&buf.ring.shared.BlocksAborted), 1)
+
+	return buf.ring.publishWrite(block)
+}
+
+// RequeueReadBuffer gives back a buffer taken by
+// GetReadBuffer without releasing it. The block is
+// returned by the next call to GetReadBuffer, in this
+// or any other process, ahead of any block not yet
+// taken.
+//
+// buf.Data must not have been modified.
+func (rw *ReadWriteCloser) RequeueReadBuffer(buf Buffer) error {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if buf.write || buf.ring == nil {
+		return ErrInvalidBuffer
+	}
+
+	defer buf.ring.seg.release()
+
+	r, block := buf.ring, buf.block
+	shared := r.shared
+
+	atomic.StoreUint32((*uint32)(&block.Owner), 0)
+
+	// If no later block has been taken, ReadStart can
+	// simply be moved back. Otherwise the block is
+	// pushed onto the requeued stack.
+	if !atomic.CompareAndSwapUint32((*uint32)(&shared.ReadStart), uint32(block.Next), buf.index) {
+		r.pushRequeued(block, buf.index)
+	}
+
+	// A reader may be waiting for a block to be sent.
+	return ((*semaphore)(&shared.SemSignal)).Post()
+}
+
+// pushRequeued pushes block onto the requeued stack.
+// Requeued holds the index plus one of the top block
+// in the low 32 bits, and a tag that is incremented by
+// every push and pop in the high 32 bits to guard
+// against ABA.
+func (r *ring) pushRequeued(block *sharedBlock, index uint32) {
+	requeued := (*uint64)(&r.shared.Requeued)
+
+	for {
+		head := atomic.LoadUint64(requeued)
+		atomic.StoreUint32((*uint32)(&block.DoneRead), requeuedBit|uint32(head))
+
+		if atomic.CompareAndSwapUint64(requeued, head, (head>>32+1)<<32|uint64(index+1)) {
+			return
+		}
+	}
+}
+
+// popRequeued takes the top block of the requeued stack.
+// It returns nil if the stack is empty.
+func (r *ring) popRequeued() (*sharedBlock, uint32) {
+	shared := r.shared
+	requeued := (*uint64)(&shared.Requeued)
+	blocks := uintptr(unsafe.Pointer(shared)) + uintptr(r.headerSize)
+
+	for {
+		head := atomic.LoadUint64(requeued)
+
+		top := uint32(head)
+		if top == 0 || top > uint32(shared.BlockCount) {
+			return nil, 0
+		}
+
+		block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(top-1)*r.fullBlockSize)))
+		below := atomic.LoadUint32((*uint32)(&block.DoneRead)) &^ requeuedBit
+
+		if atomic.CompareAndSwapUint64(requeued, head, (head>>32+1)<<32|uint64(below)) {
+			atomic.StoreUint32((*uint32)(&block.DoneRead), 0)
+			return block, top - 1
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func createRing(t *testing.T, blockCount, blockSize int) *ReadWriteCloser {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, blockCount, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		rw.Close()
+		rw.Unlink()
+	})
+
+	return rw
+}
+
+func writeAll(t *testing.T, rw *ReadWriteCloser, msgs ...string) {
+	for _, msg := range msgs {
+		if _, err := rw.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectRead(t *testing.T, rw *ReadWriteCloser, msgs ...string) {
+	p := make([]byte, 64)
+
+	for _, msg := range msgs {
+		buf, err := rw.GetReadBufferDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("GetReadBufferDeadline returned %v, expected %q", err, msg)
+		}
+
+		n := copy(p, buf.Data)
+		if err := rw.SendReadBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(p[:n]) != msg {
+			t.Fatalf("read %q, expected %q", p[:n], msg)
+		}
+	}
+}
+
+// TestAbortWriteBuffer checks that an aborted block is
+// skipped by readers and counted.
+func TestAbortWriteBuffer(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	buf, err := rw.GetWriteBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(buf.Data, "aborted")
+
+	if err := rw.AbortWriteBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAll(t, rw, "after")
+	expectRead(t, rw, "after")
+
+	stats := rw.Stats().Read
+	if stats.Aborted != 1 || stats.BlocksSent != 1 {
+		t.Errorf("Stats returned %d aborted, %d sent, expected 1, 1", stats.Aborted, stats.BlocksSent)
+	}
+
+	// Aborted blocks are skipped by the next read.
+	for i := 0; i < 2; i++ {
+		buf, err := rw.GetWriteBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := rw.AbortWriteBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeAll(t, rw, "last")
+	expectRead(t, rw, "last")
+
+	if aborted := rw.Stats().Read.Aborted; aborted != 3 {
+		t.Errorf("Stats returned %d aborted, expected 3", aborted)
+	}
+}
+
+// TestAbortWriteBufferInvalid checks that only write
+// buffers may be aborted.
+func TestAbortWriteBufferInvalid(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	if err := rw.AbortWriteBuffer(Buffer{}); err != ErrInvalidBuffer {
+		t.Errorf("AbortWriteBuffer returned %v, expected %v", err, ErrInvalidBuffer)
+	}
+
+	writeAll(t, rw, "a")
+
+	buf, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.AbortWriteBuffer(buf); err != ErrInvalidBuffer {
+		t.Errorf("AbortWriteBuffer returned %v, expected %v", err, ErrInvalidBuffer)
+	}
+
+	if err := rw.RequeueReadBuffer(Buffer{}); err != ErrInvalidBuffer {
+		t.Errorf("RequeueReadBuffer returned %v, expected %v", err, ErrInvalidBuffer)
+	}
+
+	if err := rw.SendReadBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	wbuf, err := rw.GetWriteBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.RequeueReadBuffer(wbuf); err != ErrInvalidBuffer {
+		t.Errorf("RequeueReadBuffer returned %v, expected %v", err, ErrInvalidBuffer)
+	}
+
+	rw.Close()
+
+	if err := rw.AbortWriteBuffer(wbuf); err != io.ErrClosedPipe {
+		t.Errorf("AbortWriteBuffer returned %v after Close, expected %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestRequeueReadBuffer checks that a requeued block is
+// read again before any block not yet taken, by this or
+// another process.
+func TestRequeueReadBuffer(t *testing.T) {
+	rw := createRing(t, 8, 64)
+
+	peer, err := OpenSimplex(rw.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	writeAll(t, rw, "a", "b", "c")
+
+	// With no later block taken, ReadStart is moved
+	// back.
+	buf, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.RequeueReadBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRead(t, peer, "a")
+
+	// With a later block taken, the block goes on the
+	// requeued stack.
+	b, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeAll(t, rw, "d")
+
+	if err := rw.RequeueReadBuffer(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.RequeueReadBuffer(c); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRead(t, peer, "b", "c", "d")
+
+	if stats := rw.Stats().Read; stats.BlocksReceived != 4 {
+		t.Errorf("Stats returned %d received, expected 4", stats.BlocksReceived)
+	}
+}
+
+// TestRequeueWakesReader checks that a reader waiting on
+// an empty ring is woken by a requeued block.
+func TestRequeueWakesReader(t *testing.T) {
+	rw := createRing(t, 4, 64)
+
+	writeAll(t, rw, "a", "b")
+
+	a, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectRead(t, rw, "b")
+
+	done := make(chan error, 1)
+	go func() {
+		buf, err := rw.GetReadBufferDeadline(time.Now().Add(5 * time.Second))
+		if err == nil && string(buf.Data) != "a" {
+			t.Errorf("read %q, expected %q", buf.Data, "a")
+		}
+
+		if err == nil {
+			err = rw.SendReadBuffer(buf)
+		}
+
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := rw.RequeueReadBuffer(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+// sealedBit is set in WriteStart once a ring has been
+// replaced by a later generation. Writers that see it
+// move on to the next generation, readers follow once
+// every block sent before it was set has been read.
+const sealedBit = 1 << 31
+
+// generationName returns the name of the shared memory
+// holding generation gen.
+func generationName(name string, gen uint32) string {
+	return fmt.Sprintf("%s.%d", name, gen)
+}
+
+// Resize replaces the rings with ones of blockCount
+// blocks of blockSize bytes. It may be called by any
+// attached process, though it is usually called by
+// the creator.
+//
+// The new rings are created as a new generation of the
+// shared memory, named NAME.GEN, and the old rings are
+// sealed. Blocks already taken by a writer may still be
+// sent to the old rings. Writers in every process move
+// on to the new rings when they next call
+// GetWriteBuffer, readers move on once they have read
+// every block sent to the old rings, so no data is
+// lost. An old generation is unlinked once it has been
+// drained and unmapped by every process.
+//
+// The shared memory must have been created with
+// CreateOptions.Resizable. Flags and Metadata are not
+// affected by Resize, but the counters returned by
+// Stats start again from zero in each generation.
+func (rw *ReadWriteCloser) Resize(blockCount, blockSize int) error {
+	g := geometry{uint64(blockCount), uint64(blockSize)}
+	return rw.resizeTo([2]geometry{g, g})
+}
+
+// ResizeAsymmetric is like Resize but allows each
+// direction of duplex shared memory to have its own
+// block count and block size, see
+// CreateDuplexAsymmetric. For simplex shared memory it
+// is equivalent to Resize(reqCount, reqSize).
+func (rw *ReadWriteCloser) ResizeAsymmetric(reqCount, reqSize, respCount, respSize int) error {
+	return rw.resizeTo([2]geometry{
+		{uint64(reqCount), uint64(reqSize)},
+		{uint64(respCount), uint64(respSize)},
+	})
+}
+
+func (rw *ReadWriteCloser) resizeTo(rings [2]geometry) error {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if rw.root.incompat&incompatResizable == 0 {
+		return ErrNotResizable
+	}
+
+	rw.resize.Lock()
+	defer rw.resize.Unlock()
+
+	// The write direction holds a reference to its
+	// segment, and cannot move while rw.resize is held.
+	s := (*ring)(atomic.LoadPointer(&rw.write)).seg
+
+	// This process may not have written since another
+	// process last resized the shared memory.
+	for s.sealed() {
+		var err error
+		if s, err = rw.nextSegment(s); err != nil {
+			return err
+		}
+	}
+
+	gen := s.gen + 1
+
+	// incompatAsymmetric is decided afresh for each
+	// generation. The slab region is only held by
+	// generation 0.
+	incompat := rw.root.incompat &^ (incompatAsymmetric | incompatSlab)
+
+	next, err := createSegment(generationName(rw.name, gen), gen, rw.root.perm,
+		rings, sharedHeaderSize, nil, rw.root.metadata, rw.root.features, incompat)
+	if os.IsExist(err) {
+		return ErrResized
+	} else if err != nil {
+		return err
+	}
+
+	if s.sealed() {
+		// Another process sealed s while the new
+		// generation was being created, it must not be
+		// left behind for peers to find.
+		unix.Munmap(next.data)
+		Unlink(next.name)
+		return ErrResized
+	}
+
+	// Both directions must pass through the new
+	// generation before it can be unmapped.
+	next.refs = 2
+	s.next = next
+
+	atomic.StoreUint32((*uint32)(&rw.root.rings[0].shared.LatestGeneration), gen)
+
+	// Every ring is sealed before any waiter is woken,
+	// so that the resize is never left half done. Once
+	// a ring is sealed, writers move on to the new
+	// generation, which must not then be unlinked.
+	for i := range s.rings {
+		if i > 0 && !s.duplex {
+			break
+		}
+
+		shared := s.rings[i].shared
+
+		for {
+			writeStart := atomic.LoadUint32((*uint32)(&shared.WriteStart))
+			if atomic.CompareAndSwapUint32((*uint32)(&shared.WriteStart), writeStart, writeStart|sealedBit) {
+				break
+			}
+		}
+	}
+
+	// Wake any reader or writer blocked on the old
+	// rings. Each wakes the next as it moves on.
+	for i := range s.rings {
+		if i > 0 && !s.duplex {
+			break
+		}
+
+		shared := s.rings[i].shared
+
+		if perr := ((*semaphore)(&shared.SemAvail)).Post(); err == nil {
+			err = perr
+		}
+
+		if perr := ((*semaphore)(&shared.SemSignal)).Post(); err == nil {
+			err = perr
+		}
+	}
+
+	return err
+}
+
+// Generation returns the number of times the shared
+// memory has been resized.
+func (rw *ReadWriteCloser) Generation() int {
+	rw.mapping.RLock()
+	defer rw.mapping.RUnlock()
+
+	return int(rw.latestGeneration())
+}
+
+func (rw *ReadWriteCloser) latestGeneration() uint32 {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return rw.latest
+	}
+
+	return atomic.LoadUint32((*uint32)(&rw.root.rings[0].shared.LatestGeneration))
+}
+
+// acquire returns the ring currently used in the
+// direction p with a reference held to its segment.
+func (rw *ReadWriteCloser) acquire(p *unsafe.Pointer) *ring {
+	for {
+		r := (*ring)(atomic.LoadPointer(p))
+
+		// A segment is only unmapped after every
+		// direction has moved off it, so this can only
+		// fail if p has changed.
+		if r.seg.acquire() {
+			return r
+		}
+	}
+}
+
+// advance moves the direction p from the sealed ring
+// r to the matching ring of the next generation.
+func (rw *ReadWriteCloser) advance(p *unsafe.Pointer, r *ring) error {
+	rw.resize.Lock()
+	defer rw.resize.Unlock()
+
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if atomic.LoadPointer(p) != unsafe.Pointer(r) {
+		// Another goroutine has already moved it.
+		return nil
+	}
+
+	next, err := rw.nextSegment(r.seg)
+	if err != nil {
+		return err
+	}
+
+	read, write := next.ringsFor(rw.creator)
+	if p == &rw.write {
+		read = write
+	} else {
+		// Each generation numbers its blocks from zero.
+		atomic.StoreUint32(&rw.readSeq, 0)
+	}
+
+	atomic.StorePointer(p, unsafe.Pointer(read))
+	r.seg.release()
+	return nil
+}
+
+// advanceDrainedRead moves the read direction on to
+// the next generation if its ring has been drained.
+func (rw *ReadWriteCloser) advanceDrainedRead() {
+	r := rw.acquire(&rw.read)
+
+	readStart := atomic.LoadUint32((*uint32)(&r.shared.ReadStart))
+	drained := readStart == atomic.LoadUint32((*uint32)(&r.shared.WriteEnd)) && r.drained(readStart)
+
+	r.seg.release()
+
+	if drained {
+		rw.advance(&rw.read, r)
+	}
+}
+
+// nextSegment returns the generation that follows s,
+// mapping it if this is the first direction to reach
+// it. rw.resize must be held.
+func (rw *ReadWriteCloser) nextSegment(s *segment) (*segment, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+
+	latest := atomic.LoadUint32((*uint32)(&rw.root.rings[0].shared.LatestGeneration))
+
+	for gen := s.gen + 1; gen <= latest; gen++ {
+		next, err := openSegment(generationName(rw.name, gen), gen)
+		if os.IsNotExist(err) {
+			// A generation is only unlinked once it has
+			// been drained, so it may be skipped.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if next.duplex != s.duplex {
+			unix.Munmap(next.data)
+			return nil, ErrInvalidSharedMemory
+		}
+
+		next.refs = 2
+		s.next = next
+		return next, nil
+	}
+
+	return nil, ErrInvalidSharedMemory
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// TestResize checks that blocks sent before and after a
+// resize are all read, in order, by a peer that opened
+// the shared memory before it was resized.
+func TestResize(t *testing.T) {
+	for _, duplex := range []bool{false, true} {
+		t.Run(fmt.Sprint(duplex), func(t *testing.T) {
+			name := testName(t)
+			opts := &CreateOptions{Resizable: true}
+
+			var (
+				rw, peer *ReadWriteCloser
+				err      error
+			)
+			if duplex {
+				rw, err = CreateDuplexWithOptions(name, 0600, 4, 64, opts)
+			} else {
+				rw, err = CreateSimplexWithOptions(name, 0600, 4, 64, opts)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Close()
+			defer rw.Unlink()
+
+			if duplex {
+				peer, err = OpenDuplex(name)
+			} else {
+				peer, err = OpenSimplex(name)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			msg := func(i int) []byte {
+				return bytes.Repeat([]byte{byte('a' + i)}, 32*(i+1))
+			}
+
+			// The writer is the creator, so the peer reads
+			// the ring the creator writes.
+			for i := 0; i < 2; i++ {
+				if _, err := rw.Write(msg(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := rw.Resize(8, 128); err != nil {
+				t.Fatal(err)
+			}
+
+			// A block larger than the old block size only
+			// fits the new generation.
+			for i := 2; i < 4; i++ {
+				if n, err := rw.Write(msg(i)); err != nil || n != len(msg(i)) {
+					t.Fatalf("Write returned %d, %v, expected %d, nil", n, err, len(msg(i)))
+				}
+			}
+
+			p := make([]byte, 128)
+			for i := 0; i < 4; i++ {
+				n, err := peer.Read(p)
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(p[:n], msg(i)) {
+					t.Fatalf("Read returned %q, expected %q", p[:n], msg(i))
+				}
+			}
+
+			for _, c := range []*ReadWriteCloser{rw, peer} {
+				if gen := c.Generation(); gen != 1 {
+					t.Errorf("Generation returned %d, expected 1", gen)
+				}
+			}
+
+			if s := peer.Stats().Read; s.BlockCount != 8 || s.BlockSize != 128 {
+				t.Errorf("Stats returned %d blocks of %d bytes, expected 8 of 128", s.BlockCount, s.BlockSize)
+			}
+
+			if err := rw.Resize(4, 64); err != nil {
+				t.Fatal(err)
+			}
+
+			if gen := peer.Generation(); gen != 2 {
+				t.Errorf("Generation returned %d, expected 2", gen)
+			}
+		})
+	}
+}
+
+// TestResizeNotResizable checks that Resize fails for
+// shared memory created without Resizable.
+func TestResizeNotResizable(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if err := rw.Resize(8, 64); err != ErrNotResizable {
+		t.Fatalf("Resize returned %v, expected %v", err, ErrNotResizable)
+	}
+}
+
+// TestResizeSlab checks that later generations of
+// shared memory with a slab region do not claim to hold
+// one, and that the slab is still used.
+func TestResizeSlab(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplexWithOptions(name, 0600, 4, 64, &CreateOptions{
+		Resizable: true,
+		Slab:      []SlabClass{{Size: 256, Count: 4}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	if err := rw.Resize(8, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := OpenObserver(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	h := o.Header()
+	if h.Generation != 1 {
+		t.Fatalf("Header returned generation %d, expected 1", h.Generation)
+	}
+
+	if h.IncompatFeatures&incompatSlab != 0 {
+		t.Errorf("generation 1 has incompatible features %#x, including the slab", h.IncompatFeatures)
+	}
+
+	p, err := rw.Alloc(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Free(p); err != nil {
+		t.Fatal(err)
+	}
+}
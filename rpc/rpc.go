@@ -0,0 +1,109 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// Package rpc serves and calls net/rpc, with either the
+// gob or the JSON-RPC codec, over shared memory
+// connections from package net.
+//
+// A duplex shared memory carries one connection at a
+// time, over which a Client multiplexes any number of
+// pending calls. Serve serves each connection in its
+// own goroutine, as rpc.Server.Accept does.
+package rpc
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+
+	shmNet "github.com/tmthrgd/shm-go/net"
+)
+
+// Serve accepts connections on l and serves each with
+// server until the client closes it. It returns once l
+// is closed, leaving any open connection to be served.
+// If server is nil, rpc.DefaultServer is used.
+func Serve(server *rpc.Server, l net.Listener) error {
+	return serve(l, func(conn net.Conn) {
+		ServeConn(server, conn)
+	})
+}
+
+// ServeJSON is like Serve but uses the JSON-RPC codec.
+func ServeJSON(server *rpc.Server, l net.Listener) error {
+	return serve(l, func(conn net.Conn) {
+		ServeJSONConn(server, conn)
+	})
+}
+
+func serve(l net.Listener, fn func(conn net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go fn(conn)
+	}
+}
+
+// ServeConn serves a single connection with server,
+// blocking until the client closes it. If server is
+// nil, rpc.DefaultServer is used.
+func ServeConn(server *rpc.Server, conn net.Conn) {
+	if server == nil {
+		server = rpc.DefaultServer
+	}
+
+	server.ServeConn(conn)
+}
+
+// ServeJSONConn is like ServeConn but uses the JSON-RPC
+// codec.
+func ServeJSONConn(server *rpc.Server, conn net.Conn) {
+	if server == nil {
+		server = rpc.DefaultServer
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// NewClient returns a Client that calls the server at
+// the other end of conn.
+func NewClient(conn net.Conn) *rpc.Client {
+	return rpc.NewClient(conn)
+}
+
+// NewJSONClient is like NewClient but uses the JSON-RPC
+// codec.
+func NewJSONClient(conn net.Conn) *rpc.Client {
+	return jsonrpc.NewClient(conn)
+}
+
+// Dial returns a Client connected to the server
+// listening on the shared memory at address, see
+// net.DialContext.
+func Dial(address string) (*rpc.Client, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// DialJSON is like Dial but uses the JSON-RPC codec.
+func DialJSON(address string) (*rpc.Client, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJSONClient(conn), nil
+}
+
+func dial(address string) (net.Conn, error) {
+	return shmNet.Dial(address)
+}
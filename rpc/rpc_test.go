@@ -0,0 +1,112 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmthrgd/shm-go"
+	shmNet "github.com/tmthrgd/shm-go/net"
+)
+
+const blockSize = 256
+
+type Echo struct{}
+
+func (Echo) Repeat(args *RepeatArgs, reply *string) error {
+	*reply = strings.Repeat(args.Text, args.Count)
+	return nil
+}
+
+type RepeatArgs struct {
+	Text  string
+	Count int
+}
+
+// TestRoundTrip checks that concurrent calls, whose
+// arguments and replies span many blocks, are
+// multiplexed over a single connection with either
+// codec, and that Serve returns once the listener is
+// closed, even while a connection is open.
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		serve func(*rpc.Server, *shmNet.Listener) error
+		dial  func(string) (*rpc.Client, error)
+	}{
+		{"gob", func(s *rpc.Server, l *shmNet.Listener) error { return Serve(s, l) }, Dial},
+		{"json", func(s *rpc.Server, l *shmNet.Listener) error { return ServeJSON(s, l) }, DialJSON},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := fmt.Sprintf("/shm-go-rpc-test-%s-%d", tc.name, os.Getpid())
+
+			l, err := shmNet.Listen(name, 0600, 8, blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer shm.Unlink(name)
+
+			server := rpc.NewServer()
+			if err := server.Register(Echo{}); err != nil {
+				t.Fatal(err)
+			}
+
+			served := make(chan error, 1)
+			go func() { served <- tc.serve(server, l) }()
+
+			client, err := tc.dial(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					args := &RepeatArgs{
+						Text:  fmt.Sprintf("%d:%s;", i, strings.Repeat("x", 5*blockSize)),
+						Count: 3,
+					}
+
+					var reply string
+					if err := client.Call("Echo.Repeat", args, &reply); err != nil {
+						t.Error(err)
+						return
+					}
+
+					if reply != strings.Repeat(args.Text, args.Count) {
+						t.Errorf("call %d returned a reply of %d bytes, expected %d", i, len(reply), len(args.Text)*args.Count)
+					}
+				}(i)
+			}
+
+			wg.Wait()
+
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve did not return after the listener was closed")
+			}
+
+			if err := client.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
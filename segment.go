@@ -0,0 +1,527 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"math"
+	"math/bits"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/tmthrgd/go-shm"
+)
+
+// segment is a single mapping of shared memory holding
+// one ring, or two for duplex shared memory.
+//
+// Shared memory that has been resized is made up of a
+// chain of segments, one for each generation. The
+// segment named by the caller of Create* is
+// generation 0.
+type segment struct {
+	name string
+	gen  uint32
+	perm os.FileMode
+
+	data   []byte
+	duplex bool
+
+	// rings[0] is read by the creator. rings[1] is only
+	// used for duplex shared memory.
+	rings [2]ring
+
+	metadata []byte
+	features uint32
+	incompat uint32
+
+	// slab is the slab region, see CreateOptions.Slab. It
+	// is only held by generation 0.
+	slab *slab
+
+	// refs counts the directions and Buffers using the
+	// segment, it is unmapped when it reaches zero.
+	// Generation 0 is not reference counted.
+	//
+	// Must be accessed using atomic operations
+	refs int32
+
+	// next is the following generation, it is guarded
+	// by (*ReadWriteCloser).resize.
+	next *segment
+}
+
+// ring is a single ring of blocks within a segment.
+type ring struct {
+	seg *segment
+
+	shared        *sharedMem
+	fullBlockSize uint64
+	headerSize    uint64
+}
+
+// geometry is the shape of a single ring of blocks.
+type geometry struct {
+	blockCount, blockSize uint64
+}
+
+func (g geometry) size(headerSize uint64) uint64 {
+	return headerSize + (blockHeaderSize+g.blockSize)*g.blockCount
+}
+
+// fits reports whether a segment of rings, slabSize and
+// metadataSize bytes can be mapped, that is whether its
+// size can be computed without overflowing an int. This
+// also catches negative counts and sizes, which wrap
+// around when converted to uint64.
+func fits(rings [2]geometry, headerSize [2]uint64, slabSize, metadataSize uint64, duplex bool) bool {
+	total, carry := bits.Add64(slabSize, metadataSize, 0)
+
+	for i, g := range rings {
+		if i > 0 && !duplex {
+			break
+		}
+
+		hi, ring := bits.Mul64(blockHeaderSize+g.blockSize, g.blockCount)
+		if hi != 0 || g.blockSize > math.MaxInt-blockHeaderSize {
+			return false
+		}
+
+		var c uint64
+		total, c = bits.Add64(total, ring, 0)
+		carry |= c
+		total, c = bits.Add64(total, headerSize[i], 0)
+		carry |= c
+	}
+
+	return carry == 0 && total <= math.MaxInt
+}
+
+// minBlocks returns the fewest blocks a ring may have.
+// The blocks of a ring are linked into a cycle, which
+// needs at least two. Mailboxes and broadcast rings
+// index their blocks directly.
+func minBlocks(incompat uint32) uint64 {
+	if incompat&(incompatMailbox|incompatBroadcast) != 0 {
+		return 1
+	}
+
+	return 2
+}
+
+// validGeometry reports whether a ring could have been
+// created by createSegment, so that its blocks are
+// aligned and linked into a cycle.
+func validGeometry(g geometry, headerSize uint64, incompat uint32) bool {
+	return g.blockCount >= minBlocks(incompat) && g.blockCount <= math.MaxUint32 &&
+		g.blockSize&0x3f == 0 && headerSize&0x3f == 0
+}
+
+// layout describes where each ring, the slab region
+// and the metadata lie within a segment.
+type layout struct {
+	duplex bool
+
+	rings   [2]geometry
+	offsets [2]uint64
+
+	headerSize [2]uint64
+
+	slabOffset, slabSize         uint64
+	metadataOffset, metadataSize uint64
+	size                         uint64
+}
+
+func newLayout(rings [2]geometry, headerSize [2]uint64, slabSize, metadataSize uint64, duplex bool) *layout {
+	l := &layout{
+		duplex: duplex,
+
+		rings:      rings,
+		headerSize: headerSize,
+
+		slabSize:     slabSize,
+		metadataSize: metadataSize,
+	}
+
+	l.slabOffset = rings[0].size(headerSize[0])
+
+	if duplex {
+		l.offsets[1] = l.slabOffset
+		l.slabOffset += rings[1].size(headerSize[1])
+	}
+
+	l.metadataOffset = l.slabOffset + slabSize
+	l.size = l.metadataOffset + metadataSize
+	return l
+}
+
+// readLayout validates the header of file and reads
+// the geometry of each ring. For duplex shared memory,
+// the second ring has its own header which need not
+// mirror the first. The geometry is checked as
+// createSegment checks it, as the file may be corrupt.
+func readLayout(file *os.File, prot int) (*layout, *sharedMem, []byte, error) {
+	// Guard against SIGBUS when mapping files that
+	// were not created by this package.
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if stat.Size() < sharedHeaderSize {
+		return nil, nil, nil, ErrInvalidSharedMemory
+	}
+
+	data, err := unix.Mmap(int(file.Fd()), 0, sharedHeaderSize, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
+
+	if err = checkHeader(shared); err != nil {
+		unix.Munmap(data)
+		return nil, nil, nil, err
+	}
+
+	var (
+		rings      [2]geometry
+		headerSize [2]uint64
+	)
+
+	rings[0] = geometry{uint64(shared.BlockCount), uint64(shared.BlockSize)}
+	headerSize[0] = uint64(shared.HeaderSize)
+	slabSize := uint64(shared.SlabSize)
+	metadataSize := uint64(shared.MetadataSize)
+	duplex := uint32(shared.Features)&featureDuplex != 0
+	incompat := uint32(shared.IncompatFeatures)
+
+	if err = unix.Munmap(data); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !validGeometry(rings[0], headerSize[0], incompat) ||
+		(slabSize != 0) != (incompat&incompatSlab != 0) {
+		return nil, nil, nil, ErrInvalidSharedMemory
+	}
+
+	if duplex {
+		// The second header must be mappable before the
+		// rest of the layout can be checked.
+		if !fits(rings, headerSize, 0, sharedHeaderSize, false) {
+			return nil, nil, nil, ErrInvalidSharedMemory
+		}
+
+		offset := rings[0].size(headerSize[0])
+		if uint64(stat.Size()) < offset+sharedHeaderSize {
+			return nil, nil, nil, ErrInvalidSharedMemory
+		}
+
+		if data, err = unix.Mmap(int(file.Fd()), 0, int(offset+sharedHeaderSize), unix.PROT_READ, unix.MAP_SHARED); err != nil {
+			return nil, nil, nil, err
+		}
+
+		second := (*sharedMem)(unsafe.Pointer(&data[offset]))
+		rings[1] = geometry{uint64(second.BlockCount), uint64(second.BlockSize)}
+		headerSize[1] = uint64(second.HeaderSize)
+
+		if err = unix.Munmap(data); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if headerSize[1] < sharedHeaderSize || !validGeometry(rings[1], headerSize[1], incompat) {
+			return nil, nil, nil, ErrInvalidSharedMemory
+		}
+	}
+
+	if !fits(rings, headerSize, slabSize, metadataSize, duplex) {
+		return nil, nil, nil, ErrInvalidSharedMemory
+	}
+
+	l := newLayout(rings, headerSize, slabSize, metadataSize, duplex)
+
+	if uint64(stat.Size()) < l.size {
+		return nil, nil, nil, ErrInvalidSharedMemory
+	}
+
+	data, err = unix.Mmap(int(file.Fd()), 0, int(l.size), prot, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return l, (*sharedMem)(unsafe.Pointer(&data[0])), data, nil
+}
+
+func newSegment(name string, gen uint32, data []byte, l *layout) (*segment, error) {
+	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
+
+	s := &segment{
+		name: name,
+		gen:  gen,
+
+		data:   data,
+		duplex: l.duplex,
+
+		// The metadata is copied so that it may still be
+		// read once the segment has been unmapped.
+		metadata: append([]byte(nil), data[l.metadataOffset:l.size]...),
+		features: uint32(shared.Features),
+		incompat: uint32(shared.IncompatFeatures),
+	}
+
+	if l.slabSize != 0 {
+		var err error
+		if s.slab, err = newSlab(data[l.slabOffset:l.metadataOffset]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range s.rings {
+		if i > 0 && !s.duplex {
+			break
+		}
+
+		s.rings[i] = ring{
+			seg: s,
+
+			shared:        (*sharedMem)(unsafe.Pointer(&data[l.offsets[i]])),
+			fullBlockSize: blockHeaderSize + l.rings[i].blockSize,
+			headerSize:    l.headerSize[i],
+		}
+	}
+
+	return s, nil
+}
+
+func createSegment(name string, gen uint32, perm os.FileMode, rings [2]geometry, headerSize uint64, slab []SlabClass, metadata []byte, features, incompat uint32) (*segment, error) {
+	duplex := features&featureDuplex != 0
+
+	if !duplex {
+		rings[1] = geometry{}
+	} else if rings[0] != rings[1] {
+		incompat |= incompatAsymmetric
+	}
+
+	if rings[0].blockSize&0x3f != 0 || rings[1].blockSize&0x3f != 0 {
+		return nil, ErrNotMultipleOf64
+	}
+
+	for i, g := range rings {
+		if i > 0 && !duplex {
+			break
+		}
+
+		if g.blockCount < minBlocks(incompat) || g.blockCount > math.MaxUint32 {
+			return nil, ErrInvalidSharedMemory
+		}
+	}
+
+	if uint64(len(metadata)) > math.MaxUint32 {
+		return nil, ErrMetadataTooLarge
+	}
+
+	slabSize, err := slabRegionSize(slab)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fits(rings, [2]uint64{headerSize, headerSize}, slabSize, uint64(len(metadata)), duplex) {
+		return nil, ErrInvalidSharedMemory
+	}
+
+	if slabSize != 0 {
+		incompat |= incompatSlab
+	}
+
+	file, err := shm.Open(name, unix.O_CREAT|unix.O_EXCL|unix.O_TRUNC|unix.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	l := newLayout(rings, [2]uint64{headerSize, headerSize}, slabSize, uint64(len(metadata)), duplex)
+
+	if err = file.Truncate(int64(l.size)); err != nil {
+		shm.Unlink(name)
+		return nil, err
+	}
+
+	data, err := unix.Mmap(int(file.Fd()), 0, int(l.size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		shm.Unlink(name)
+		return nil, err
+	}
+
+	for i, g := range rings {
+		if i > 0 && !duplex {
+			break
+		}
+
+		shared := (*sharedMem)(unsafe.Pointer(&data[l.offsets[i]]))
+		fullBlockSize := blockHeaderSize + g.blockSize
+		blockCount := uint32(g.blockCount)
+
+		/*
+		 * memset already set:
+		 *	shared.ReadStart, shared.ReadEnd = 0, 0
+		 *	shared.WriteStart, shared.WriteEnd = 0, 0
+		 *	shared.SemSignal, shared.SemAvail = 0, 0
+		 *	shared.Blocks[i].Size = 0
+		 *	shared.Blocks[i].DoneRead, shared.Blocks[i].DoneWrite = 0, 0
+		 */
+		*(*uint32)(&shared.BlockCount), *(*uint64)(&shared.BlockSize) = blockCount, g.blockSize
+		*(*uint32)(&shared.HeaderSize) = uint32(headerSize)
+
+		for j := uint32(0); j < blockCount; j++ {
+			block := (*sharedBlock)(unsafe.Pointer(&data[l.offsets[i]+headerSize+uint64(j)*fullBlockSize]))
+
+			switch j {
+			case 0:
+				block.Next, *(*uint32)(&block.Prev) = 1, blockCount-1
+			case blockCount - 1:
+				block.Next, *(*uint32)(&block.Prev) = 0, blockCount-2
+			default:
+				*(*uint32)(&block.Next), *(*uint32)(&block.Prev) = j+1, j-1
+			}
+		}
+	}
+
+	shared := (*sharedMem)(unsafe.Pointer(&data[0]))
+	*(*uint32)(&shared.MetadataSize) = uint32(copy(data[l.metadataOffset:], metadata))
+	*(*uint64)(&shared.SlabSize) = slabSize
+	*(*uint32)(&shared.Generation) = gen
+
+	if slabSize != 0 {
+		initSlab(data[l.slabOffset:l.metadataOffset], slab)
+	}
+
+	initHeader(shared, features, incompat)
+	atomic.StoreUint32((*uint32)(&shared.Magic), magic)
+
+	s, err := newSegment(name, gen, data, l)
+	if err != nil {
+		unix.Munmap(data)
+		shm.Unlink(name)
+		return nil, err
+	}
+
+	s.perm = perm
+	return s, nil
+}
+
+func openSegment(name string, gen uint32) (*segment, error) {
+	file, err := shm.Open(name, unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	l, _, data, err := readLayout(file, unix.PROT_READ|unix.PROT_WRITE)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSegment(name, gen, data, l)
+	if err != nil {
+		unix.Munmap(data)
+		return nil, err
+	}
+
+	s.perm = stat.Mode().Perm()
+	return s, nil
+}
+
+// ringsFor returns the rings read and written by
+// either the creator or the opener of the shared
+// memory.
+func (s *segment) ringsFor(creator bool) (read, write *ring) {
+	switch {
+	case !s.duplex:
+		return &s.rings[0], &s.rings[0]
+	case creator:
+		return &s.rings[0], &s.rings[1]
+	default:
+		return &s.rings[1], &s.rings[0]
+	}
+}
+
+// acquire takes a reference to the segment. It fails
+// if the segment has already been unmapped.
+func (s *segment) acquire() bool {
+	if s.gen == 0 {
+		return true
+	}
+
+	for {
+		refs := atomic.LoadInt32(&s.refs)
+		if refs == 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&s.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the segment. The last
+// reference unmaps it, and unlinks it if every ring
+// has been drained.
+func (s *segment) release() {
+	if s.gen == 0 || atomic.AddInt32(&s.refs, -1) != 0 {
+		return
+	}
+
+	if s.done() {
+		Unlink(s.name)
+	}
+
+	unix.Munmap(s.data)
+}
+
+// sealed reports whether the segment has been
+// replaced by a later generation.
+func (s *segment) sealed() bool {
+	return atomic.LoadUint32((*uint32)(&s.rings[0].shared.WriteStart))&sealedBit != 0
+}
+
+// done reports whether the segment has been sealed
+// and every block sent to it has been read.
+func (s *segment) done() bool {
+	for i := range s.rings {
+		if i > 0 && !s.duplex {
+			break
+		}
+
+		shared := s.rings[i].shared
+
+		readStart := atomic.LoadUint32((*uint32)(&shared.ReadStart))
+		if readStart != atomic.LoadUint32((*uint32)(&shared.WriteEnd)) || !s.rings[i].drained(readStart) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// drained reports whether the ring has been sealed,
+// no block after readStart was taken by a writer
+// before it was, and no block is waiting to be taken
+// again after RequeueReadBuffer. The caller must have
+// checked that readStart is equal to WriteEnd.
+func (r *ring) drained(readStart uint32) bool {
+	writeStart := atomic.LoadUint32((*uint32)(&r.shared.WriteStart))
+	return writeStart&sealedBit != 0 && writeStart&^sealedBit == readStart &&
+		uint32(atomic.LoadUint64((*uint64)(&r.shared.Requeued))) == 0
+}
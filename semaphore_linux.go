@@ -0,0 +1,235 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"golang.org/x/sys/unix"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	futexWait = 0
+	futexWake = 1
+)
+
+// semaphore is a process-shared counting semaphore
+// built on futex(2).
+//
+// Unlike sem_t, its layout is identical for 32-bit
+// and 64-bit processes, so it may be shared between
+// them. The zero value is a semaphore with a count
+// of zero.
+//
+// The first word holds the count, the second holds
+// the number of waiters.
+type semaphore [2]uint32
+
+// Wait decrements the count, waiting for a Post if it
+// is zero.
+//
+// changed, if not nil, is called once the caller is
+// counted by Waiting and before each sleep. Wait
+// returns early, without decrementing the count, if it
+// reports true. A caller that checked its condition
+// before calling Wait must check it again in changed,
+// or it may miss the wake up passed on by a process
+// that saw no one waiting.
+func (s *semaphore) Wait(changed func() bool) error {
+	return s.WaitDeadline(time.Time{}, changed)
+}
+
+// WaitDeadline is like Wait but returns
+// os.ErrDeadlineExceeded once deadline has passed. A
+// zero deadline waits forever.
+func (s *semaphore) WaitDeadline(deadline time.Time, changed func() bool) error {
+	atomic.AddUint32(&s[1], 1)
+	defer atomic.AddUint32(&s[1], ^uint32(0))
+
+	for {
+		if v := atomic.LoadUint32(&s[0]); v != 0 {
+			if atomic.CompareAndSwapUint32(&s[0], v, v-1) {
+				return nil
+			}
+
+			continue
+		}
+
+		if changed != nil && changed() {
+			return nil
+		}
+
+		var timeout *unix.Timespec
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+
+			ts := unix.NsecToTimespec(int64(d))
+			timeout = &ts
+		}
+
+		_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(&s[0])), futexWait, 0, uintptr(unsafe.Pointer(timeout)), 0, 0)
+
+		switch errno {
+		case 0, unix.EAGAIN, unix.EINTR, unix.ETIMEDOUT:
+			// The count is checked again before the
+			// deadline, so a Post that raced with the
+			// timeout is not lost.
+		default:
+			return errno
+		}
+	}
+}
+
+// Wake wakes every process in Wait without posting.
+// Each checks its changed callback and goes back to
+// sleep unless it reports true.
+func (s *semaphore) Wake() error {
+	if atomic.LoadUint32(&s[1]) == 0 {
+		return nil
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(&s[0])), futexWake, math.MaxInt32, 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// wakeOn calls Wake once done is closed, and stops when
+// the returned function is called. done may be nil.
+//
+// Wake does not change the count, so a waiter that
+// checked done just before it was closed would sleep
+// through it. Wake is repeated, with a growing delay,
+// until the waiter stops it.
+func (s *semaphore) wakeOn(done <-chan struct{}) (stop func()) {
+	if done == nil {
+		return func() {}
+	}
+
+	exited, finished := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-done:
+		case <-exited:
+			return
+		}
+
+		for delay := time.Millisecond; ; delay *= 2 {
+			s.Wake()
+
+			select {
+			case <-exited:
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	// The shared memory must not be unmapped beneath a
+	// Wake, so stop waits for it to finish.
+	return func() {
+		close(exited)
+		<-finished
+	}
+}
+
+// stopped reports whether done, which may be nil, is
+// closed.
+func stopped(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waiting reports whether any process is in Wait.
+func (s *semaphore) Waiting() bool {
+	return atomic.LoadUint32(&s[1]) != 0
+}
+
+func (s *semaphore) Post() error {
+	atomic.AddUint32(&s[0], 1)
+
+	if atomic.LoadUint32(&s[1]) == 0 {
+		return nil
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(&s[0])), futexWake, 1, 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// event is a process-shared condition that any number
+// of processes may wait on, built on futex(2).
+//
+// The first word is incremented by each Broadcast, the
+// second holds the number of waiters. The zero value is
+// ready to use.
+type event [2]uint32
+
+// Load returns the current value of the event. It
+// should be called before checking the condition that
+// is waited for.
+func (e *event) Load() uint32 {
+	return atomic.LoadUint32(&e[0])
+}
+
+// Wait blocks until Broadcast has been called since
+// Load returned v. It may return early, so the caller
+// must check the condition again.
+func (e *event) Wait(v uint32) error {
+	return e.WaitTimeout(v, 0)
+}
+
+// WaitTimeout is like Wait but also returns once
+// timeout has passed. A zero timeout waits forever.
+func (e *event) WaitTimeout(v uint32, timeout time.Duration) error {
+	var ts *unix.Timespec
+	if timeout > 0 {
+		t := unix.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+
+	atomic.AddUint32(&e[1], 1)
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(&e[0])), futexWait, uintptr(v), uintptr(unsafe.Pointer(ts)), 0, 0)
+	atomic.AddUint32(&e[1], ^uint32(0))
+
+	switch errno {
+	case 0, unix.EAGAIN, unix.EINTR, unix.ETIMEDOUT:
+		return nil
+	default:
+		return errno
+	}
+}
+
+// Broadcast wakes every process waiting on the event.
+func (e *event) Broadcast() error {
+	atomic.AddUint32(&e[0], 1)
+
+	if atomic.LoadUint32(&e[1]) == 0 {
+		return nil
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(&e[0])), futexWake, math.MaxInt32, 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -3,13 +3,12 @@
 // Modified BSD License license that can be found in
 // the LICENSE file.
 
-// +build !linux !386,!amd64
+// +build ignore
 
 package shm
 
 /*
-#include <stdint.h>    // For (u)int*_t
-#include <semaphore.h> // For sem_*
+#include <stdint.h> // For (u)int*_t
 
 typedef struct {
 	uint32_t Next;
@@ -20,17 +19,29 @@ typedef struct {
 
 	uint64_t Size;
 
-	uint8_t Flags[(0x40-(2*2*sizeof(uint32_t)+sizeof(uint64_t))&0x3f)&0x3f];
+	uint64_t PublishedAt;
+
+	uint32_t Seq;
+	uint32_t Owner;
+
+	uint8_t Flags[(0x40-(2*2*sizeof(uint32_t)+2*sizeof(uint64_t)+2*sizeof(uint32_t))&0x3f)&0x3f];
 
 	uint8_t Data[];
 } shared_block_t;
 
 typedef struct {
-	uint32_t Version;
-	uint32_t __padding0;
+	uint32_t Magic;
+	uint16_t MajorVersion;
+	uint16_t MinorVersion;
+
+	uint32_t HeaderSize;
+	uint32_t MetadataSize;
+
+	uint32_t Features;
+	uint32_t IncompatFeatures;
 
 	uint32_t BlockCount;
-	uint32_t __padding1;
+	uint32_t __padding0;
 
 	uint64_t BlockSize;
 
@@ -40,13 +51,97 @@ typedef struct {
 	uint32_t WriteStart;
 	uint32_t WriteEnd;
 
-	sem_t SemSignal;
-	sem_t SemAvail;
+	uint32_t SemSignal[2];
+	uint32_t SemAvail[2];
+
+	uint32_t Flags[8];
+
+	uint8_t __reserved[(0x40-(11*sizeof(uint32_t)+2*sizeof(uint16_t)+sizeof(uint64_t)+2*2*sizeof(uint32_t)+8*sizeof(uint32_t))&0x3f)&0x3f];
+
+	uint64_t BlocksSent;
+	uint64_t BytesSent;
+
+	uint64_t BlocksReceived;
+	uint64_t BytesReceived;
+
+	uint64_t ReadWaits;
+	uint64_t WriteWaits;
+
+	uint32_t CreatorPID;
+	uint32_t __padding1;
+
+	uint64_t ReadWaitNanos;
+	uint64_t ReadWaitHist[8];
+
+	uint64_t WriteWaitNanos;
+	uint64_t WriteWaitHist[8];
+
+	uint32_t Generation;
+	uint32_t LatestGeneration;
+
+	uint32_t WriteSeq;
+	uint32_t __padding2;
+
+	uint64_t BlocksOverwritten;
+
+	uint64_t SlabSize;
 
-	uint32_t Flags[((0x40-(4*2*sizeof(uint32_t)+sizeof(uint64_t)+2*sizeof(sem_t))&0x3f)&0x3f)/4];
+	uint64_t BlocksAborted;
+
+	uint64_t Requeued;
+
+	uint8_t __reserved1[(0x40-(6*sizeof(uint64_t)+2*sizeof(uint32_t)+2*9*sizeof(uint64_t)+2*sizeof(uint32_t)+2*sizeof(uint32_t)+4*sizeof(uint64_t))&0x3f)&0x3f];
 
 	shared_block_t Blocks[];
 } shared_mem_t;
+
+typedef struct {
+	uint32_t State;
+	uint32_t PID;
+
+	uint64_t Head;
+	uint64_t Tail;
+
+	uint8_t __reserved[(0x40-(2*sizeof(uint32_t)+2*sizeof(uint64_t)))&0x3f];
+} shared_subscriber_t;
+
+typedef struct {
+	uint64_t WriteSeq;
+
+	uint32_t Policy;
+	uint32_t __padding0;
+
+	uint32_t Signal[2];
+	uint32_t Avail[2];
+
+	uint8_t __reserved[(0x40-(sizeof(uint64_t)+2*sizeof(uint32_t)+2*2*sizeof(uint32_t)))&0x3f];
+
+	shared_subscriber_t Subscribers[];
+} shared_broadcast_t;
+
+typedef struct {
+	uint64_t Size;
+
+	uint32_t Count;
+	uint32_t __padding0;
+
+	uint64_t NextOffset;
+	uint64_t DataOffset;
+
+	uint64_t Free;
+	uint64_t Allocated;
+
+	uint8_t __reserved[(0x40-(5*sizeof(uint64_t)+2*sizeof(uint32_t)))&0x3f];
+} shared_slab_class_t;
+
+typedef struct {
+	uint32_t ClassCount;
+	uint32_t __padding0;
+
+	uint8_t __reserved[(0x40-2*sizeof(uint32_t))&0x3f];
+
+	shared_slab_class_t Classes[];
+} shared_slab_t;
 */
 import "C"
 
@@ -54,11 +149,23 @@ type sharedBlock C.shared_block_t
 
 type sharedMem C.shared_mem_t
 
+type sharedSubscriber C.shared_subscriber_t
+
+type sharedBroadcast C.shared_broadcast_t
+
+type sharedSlabClass C.shared_slab_class_t
+
+type sharedSlab C.shared_slab_t
+
 const (
 	sharedHeaderSize = C.sizeof_shared_mem_t
 	sharedFlagsSize  = len(sharedMem{}.Flags)
 	blockHeaderSize  = C.sizeof_shared_block_t
 	blockFlagsSize   = len(sharedBlock{}.Flags)
 
-	version = uint32((^uint(0)>>32)&0x80000000) | 0x00000001
+	broadcastHeaderSize = C.sizeof_shared_broadcast_t
+	subscriberSize      = C.sizeof_shared_subscriber_t
+
+	slabHeaderSize = C.sizeof_shared_slab_t
+	slabClassSize  = C.sizeof_shared_slab_class_t
 )
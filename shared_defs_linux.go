@@ -0,0 +1,105 @@
+// Created by cgo -godefs - DO NOT EDIT
+// cgo -godefs shared.go
+
+package shm
+
+type sharedBlock struct {
+	Next        uint32
+	Prev        uint32
+	DoneRead    uint32
+	DoneWrite   uint32
+	Size        uint64
+	PublishedAt uint64
+	Seq         uint32
+	Owner       uint32
+	Flags       [24]uint8
+}
+
+type sharedMem struct {
+	Magic             uint32
+	MajorVersion      uint16
+	MinorVersion      uint16
+	HeaderSize        uint32
+	MetadataSize      uint32
+	Features          uint32
+	IncompatFeatures  uint32
+	BlockCount        uint32
+	X__padding0       uint32
+	BlockSize         uint64
+	ReadStart         uint32
+	ReadEnd           uint32
+	WriteStart        uint32
+	WriteEnd          uint32
+	SemSignal         [2]uint32
+	SemAvail          [2]uint32
+	Flags             [8]uint32
+	X__reserved       [24]uint8
+	BlocksSent        uint64
+	BytesSent         uint64
+	BlocksReceived    uint64
+	BytesReceived     uint64
+	ReadWaits         uint64
+	WriteWaits        uint64
+	CreatorPID        uint32
+	X__padding1       uint32
+	ReadWaitNanos     uint64
+	ReadWaitHist      [8]uint64
+	WriteWaitNanos    uint64
+	WriteWaitHist     [8]uint64
+	Generation        uint32
+	LatestGeneration  uint32
+	WriteSeq          uint32
+	X__padding2       uint32
+	BlocksOverwritten uint64
+	SlabSize          uint64
+	BlocksAborted     uint64
+	Requeued          uint64
+	X__reserved1      [8]uint8
+}
+
+type sharedSubscriber struct {
+	State       uint32
+	PID         uint32
+	Head        uint64
+	Tail        uint64
+	X__reserved [40]uint8
+}
+
+type sharedBroadcast struct {
+	WriteSeq    uint64
+	Policy      uint32
+	X__padding0 uint32
+	Signal      [2]uint32
+	Avail       [2]uint32
+	X__reserved [32]uint8
+}
+
+type sharedSlabClass struct {
+	Size        uint64
+	Count       uint32
+	X__padding0 uint32
+	NextOffset  uint64
+	DataOffset  uint64
+	Free        uint64
+	Allocated   uint64
+	X__reserved [16]uint8
+}
+
+type sharedSlab struct {
+	ClassCount  uint32
+	X__padding0 uint32
+	X__reserved [56]uint8
+}
+
+const (
+	sharedHeaderSize = 0x180
+	sharedFlagsSize  = len(sharedMem{}.Flags)
+	blockHeaderSize  = 0x40
+	blockFlagsSize   = len(sharedBlock{}.Flags)
+
+	broadcastHeaderSize = 0x40
+	subscriberSize      = 0x40
+
+	slabHeaderSize = 0x40
+	slabClassSize  = 0x40
+)
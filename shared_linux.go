@@ -5,7 +5,6 @@
 
 // +build linux
 
-//go:generate sh -c "GOARCH=386 go tool cgo -godefs shared.go | gofmt > shared_linux_386.go"
-//go:generate sh -c "GOARCH=amd64 go tool cgo -godefs shared.go | gofmt > shared_linux_amd64.go"
+//go:generate sh -c "go tool cgo -godefs shared.go | gofmt > shared_defs_linux.go"
 
 package shm
@@ -0,0 +1,452 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	payloadFlagIndex = 0
+	payloadFlagMask  = 0x02
+
+	// payloadDescriptorSize is the size of the offset
+	// and length sent through the ring by SendPayload.
+	payloadDescriptorSize = 16
+
+	maxSlabClasses = 16
+	maxSlabSlots   = 1 << 30
+
+	// slotAllocated is held in the next array in place
+	// of the slot below for each slot that has been
+	// allocated, so that a payload freed twice can be
+	// detected.
+	slotAllocated = ^uint32(0)
+)
+
+// SlabClass is a class of equally sized slots in the
+// slab region.
+type SlabClass struct {
+	// Size is the size of each slot, it is rounded up
+	// to a multiple of 64.
+	Size int
+	// Count is the number of slots.
+	Count int
+}
+
+// Payload is a slot allocated from the slab region.
+//
+// Data aliases the shared memory. It remains valid
+// until the payload is freed, after which it must not
+// be used.
+type Payload struct {
+	// Offset is the offset of the slot within the slab
+	// region. Together with len(Data) it is all that
+	// need be sent to another process, see PayloadAt.
+	Offset int
+
+	Data []byte
+}
+
+// slab is a view of the slab region of a segment.
+//
+// Each class keeps its free slots on a stack. Free
+// holds the index of the top slot plus one in the low
+// 32 bits, and a tag that is incremented by every push
+// and pop in the high 32 bits to guard against ABA.
+// The slot below each free slot is held in the next
+// array of the class, again plus one. Allocated slots
+// hold slotAllocated instead.
+type slab struct {
+	region  []byte
+	classes []*sharedSlabClass
+	next    [][]uint32
+}
+
+func slabClasses(classes []SlabClass) ([]SlabClass, error) {
+	if len(classes) > maxSlabClasses {
+		return nil, ErrInvalidSlabClass
+	}
+
+	classes = append([]SlabClass(nil), classes...)
+
+	for i, c := range classes {
+		if c.Size <= 0 || c.Count <= 0 || c.Count > maxSlabSlots {
+			return nil, ErrInvalidSlabClass
+		}
+
+		classes[i].Size = (c.Size + 0x3f) &^ 0x3f
+	}
+
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].Size < classes[j].Size
+	})
+
+	return classes, nil
+}
+
+func slabRegionSize(classes []SlabClass) (uint64, error) {
+	if len(classes) == 0 {
+		return 0, nil
+	}
+
+	classes, err := slabClasses(classes)
+	if err != nil {
+		return 0, err
+	}
+
+	size := slabHeaderSize + uint64(len(classes))*slabClassSize
+
+	for _, c := range classes {
+		size += (4*uint64(c.Count) + 0x3f) &^ 0x3f
+		size += uint64(c.Size) * uint64(c.Count)
+	}
+
+	return size, nil
+}
+
+// initSlab lays out the classes in region and pushes
+// every slot onto the free stack of its class. region
+// must be zeroed and at least slabRegionSize(classes)
+// long.
+func initSlab(region []byte, classes []SlabClass) {
+	classes, _ = slabClasses(classes)
+
+	header := (*sharedSlab)(unsafe.Pointer(&region[0]))
+	*(*uint32)(&header.ClassCount) = uint32(len(classes))
+
+	offset := slabHeaderSize + uint64(len(classes))*slabClassSize
+
+	for i, c := range classes {
+		class := (*sharedSlabClass)(unsafe.Pointer(&region[slabHeaderSize+uint64(i)*slabClassSize]))
+
+		count := uint32(c.Count)
+		*(*uint64)(&class.Size), *(*uint32)(&class.Count) = uint64(c.Size), count
+
+		*(*uint64)(&class.NextOffset) = offset
+		next := unsafe.Slice((*uint32)(unsafe.Pointer(&region[offset])), count)
+		offset += (4*uint64(count) + 0x3f) &^ 0x3f
+
+		*(*uint64)(&class.DataOffset) = offset
+		offset += uint64(c.Size) * uint64(count)
+
+		for j := range next[:count-1] {
+			next[j] = uint32(j) + 2
+		}
+
+		*(*uint64)(&class.Free) = 1
+	}
+}
+
+func newSlab(region []byte) (*slab, error) {
+	size := uint64(len(region))
+
+	if size < slabHeaderSize {
+		return nil, ErrInvalidSharedMemory
+	}
+
+	header := (*sharedSlab)(unsafe.Pointer(&region[0]))
+	count := uint64(header.ClassCount)
+
+	if count > maxSlabClasses || size < slabHeaderSize+count*slabClassSize {
+		return nil, ErrInvalidSharedMemory
+	}
+
+	s := &slab{
+		region:  region,
+		classes: make([]*sharedSlabClass, count),
+		next:    make([][]uint32, count),
+	}
+
+	for i := range s.classes {
+		class := (*sharedSlabClass)(unsafe.Pointer(&region[slabHeaderSize+uint64(i)*slabClassSize]))
+
+		slots := uint64(class.Count)
+		nextOffset, dataOffset := uint64(class.NextOffset), uint64(class.DataOffset)
+
+		if slots == 0 || slots > maxSlabSlots || uint64(class.Size)&0x3f != 0 ||
+			nextOffset > size || 4*slots > size-nextOffset ||
+			dataOffset > size || slots*uint64(class.Size) > size-dataOffset {
+			return nil, ErrInvalidSharedMemory
+		}
+
+		s.classes[i] = class
+		s.next[i] = unsafe.Slice((*uint32)(unsafe.Pointer(&region[nextOffset])), slots)
+	}
+
+	return s, nil
+}
+
+func (s *slab) alloc(n int) (Payload, error) {
+	fits := false
+
+	for i, class := range s.classes {
+		size := uint64(class.Size)
+		if uint64(n) > size {
+			continue
+		}
+
+		fits = true
+
+		slot, ok := s.pop(i)
+		if !ok {
+			continue
+		}
+
+		atomic.AddUint64((*uint64)(&class.Allocated), 1)
+
+		offset := uint64(class.DataOffset) + uint64(slot)*size
+		return Payload{
+			Offset: int(offset),
+			Data:   s.region[offset : offset+uint64(n) : offset+size],
+		}, nil
+	}
+
+	if !fits {
+		return Payload{}, ErrPayloadTooLarge
+	}
+
+	return Payload{}, ErrSlabFull
+}
+
+func (s *slab) free(offset int) error {
+	i, slot, ok := s.slot(offset)
+	if !ok {
+		return ErrInvalidPayload
+	}
+
+	if !s.push(i, slot) {
+		return ErrDoubleFree
+	}
+
+	atomic.AddUint64((*uint64)(&s.classes[i].Allocated), ^uint64(0))
+	return nil
+}
+
+func (s *slab) at(offset, length int) (Payload, error) {
+	i, _, ok := s.slot(offset)
+	if !ok || length < 0 || uint64(length) > uint64(s.classes[i].Size) {
+		return Payload{}, ErrInvalidPayload
+	}
+
+	start, size := uint64(offset), uint64(s.classes[i].Size)
+	return Payload{
+		Offset: offset,
+		Data:   s.region[start : start+uint64(length) : start+size],
+	}, nil
+}
+
+// slot returns the class and index of the slot that
+// starts at offset.
+func (s *slab) slot(offset int) (class int, slot uint32, ok bool) {
+	if offset < 0 {
+		return 0, 0, false
+	}
+
+	for i, c := range s.classes {
+		start, size := uint64(c.DataOffset), uint64(c.Size)
+		if uint64(offset) < start || uint64(offset) >= start+size*uint64(c.Count) {
+			continue
+		}
+
+		if (uint64(offset)-start)%size != 0 {
+			return 0, 0, false
+		}
+
+		return i, uint32((uint64(offset) - start) / size), true
+	}
+
+	return 0, 0, false
+}
+
+func (s *slab) pop(class int) (uint32, bool) {
+	free, next := (*uint64)(&s.classes[class].Free), s.next[class]
+
+	for {
+		head := atomic.LoadUint64(free)
+
+		top := uint32(head)
+		if top == 0 || top > uint32(len(next)) {
+			return 0, false
+		}
+
+		below := atomic.LoadUint32(&next[top-1])
+
+		if atomic.CompareAndSwapUint64(free, head, (head>>32+1)<<32|uint64(below)) {
+			atomic.StoreUint32(&next[top-1], slotAllocated)
+			return top - 1, true
+		}
+	}
+}
+
+// push returns slot to the free stack of class. It
+// reports false, and leaves the stack untouched, if the
+// slot was not allocated.
+//
+// A slot freed twice is only detected if it has not
+// been allocated again in between.
+func (s *slab) push(class int, slot uint32) bool {
+	free, next := (*uint64)(&s.classes[class].Free), s.next[class]
+
+	head := atomic.LoadUint64(free)
+	if !atomic.CompareAndSwapUint32(&next[slot], slotAllocated, uint32(head)) {
+		return false
+	}
+
+	for !atomic.CompareAndSwapUint64(free, head, (head>>32+1)<<32|uint64(slot+1)) {
+		head = atomic.LoadUint64(free)
+		atomic.StoreUint32(&next[slot], uint32(head))
+	}
+
+	return true
+}
+
+// SlabStats describes a single class of the slab
+// region.
+type SlabStats struct {
+	Size, Count int
+
+	// Allocated is the number of slots that have been
+	// allocated and not yet freed.
+	Allocated int
+}
+
+// Alloc allocates a payload of n bytes from the
+// smallest slab class with a free slot. It never
+// waits, it returns ErrSlabFull if every class large
+// enough to hold n bytes is full.
+//
+// The shared memory must have been created with
+// CreateOptions.Slab. A payload may be freed by any
+// attached process, but must be freed exactly once.
+func (rw *ReadWriteCloser) Alloc(n int) (Payload, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return Payload{}, io.ErrClosedPipe
+	}
+
+	if rw.root.slab == nil {
+		return Payload{}, ErrNoSlab
+	}
+
+	if n < 0 {
+		return Payload{}, ErrInvalidPayload
+	}
+
+	return rw.root.slab.alloc(n)
+}
+
+// Free returns p to the slab region. p must not be used
+// afterwards. It returns ErrDoubleFree if p has already
+// been freed and not since allocated again.
+func (rw *ReadWriteCloser) Free(p Payload) error {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return io.ErrClosedPipe
+	}
+
+	if rw.root.slab == nil {
+		return ErrNoSlab
+	}
+
+	return rw.root.slab.free(p.Offset)
+}
+
+// PayloadAt returns the payload of length bytes at
+// offset in the slab region, as allocated by Alloc in
+// this or another process.
+func (rw *ReadWriteCloser) PayloadAt(offset, length int) (Payload, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return Payload{}, io.ErrClosedPipe
+	}
+
+	if rw.root.slab == nil {
+		return Payload{}, ErrNoSlab
+	}
+
+	return rw.root.slab.at(offset, length)
+}
+
+// SendPayload sends the offset and length of p through
+// the ring, the payload itself is not copied. The
+// reader takes ownership of p and must free it.
+func (rw *ReadWriteCloser) SendPayload(p Payload) error {
+	if rw.root.slab == nil {
+		return ErrNoSlab
+	}
+
+	buf, err := rw.GetWriteBuffer()
+	if err != nil {
+		return err
+	}
+
+	buf.Data = buf.Data[:payloadDescriptorSize]
+	binary.LittleEndian.PutUint64(buf.Data[0:], uint64(p.Offset))
+	binary.LittleEndian.PutUint64(buf.Data[8:], uint64(len(p.Data)))
+
+	buf.Flags[payloadFlagIndex] |= payloadFlagMask
+
+	_, err = rw.SendWriteBuffer(buf)
+	return err
+}
+
+// GetPayload receives the next payload sent by
+// SendPayload. The caller must free it once it is done
+// with it.
+//
+// It returns ErrInvalidPayload, and releases the block,
+// if the next block was not sent by SendPayload.
+func (rw *ReadWriteCloser) GetPayload() (Payload, error) {
+	if rw.root.slab == nil {
+		return Payload{}, ErrNoSlab
+	}
+
+	buf, err := rw.GetReadBuffer()
+	if err != nil {
+		return Payload{}, err
+	}
+
+	var offset, length uint64
+
+	isPayload := buf.Flags[payloadFlagIndex]&payloadFlagMask != 0 && len(buf.Data) == payloadDescriptorSize
+	if isPayload {
+		offset = binary.LittleEndian.Uint64(buf.Data[0:])
+		length = binary.LittleEndian.Uint64(buf.Data[8:])
+	}
+
+	if err = rw.SendReadBuffer(buf); err != nil {
+		return Payload{}, err
+	}
+
+	if !isPayload {
+		return Payload{}, ErrInvalidPayload
+	}
+
+	return rw.root.slab.at(int(offset), int(length))
+}
+
+// SlabStats returns the statistics of each class of
+// the slab region, ordered by size. It returns nil if
+// the shared memory has no slab region.
+func (rw *ReadWriteCloser) SlabStats() []SlabStats {
+	if rw.root.slab == nil {
+		return nil
+	}
+
+	stats := make([]SlabStats, len(rw.root.slab.classes))
+	for i, c := range rw.root.slab.classes {
+		stats[i] = SlabStats{
+			Size:  int(c.Size),
+			Count: int(c.Count),
+
+			Allocated: int(atomic.LoadUint64((*uint64)(&c.Allocated))),
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,326 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func createSlab(t *testing.T, classes ...SlabClass) *ReadWriteCloser {
+	name := testName(t)
+
+	rw, err := CreateSimplexWithOptions(name, 0600, 4, 64, &CreateOptions{
+		Slab: classes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		rw.Close()
+		rw.Unlink()
+	})
+
+	return rw
+}
+
+// TestSlab checks that payloads are allocated from the
+// smallest class that fits, are visible through
+// PayloadAt and may be allocated again once freed.
+func TestSlab(t *testing.T) {
+	rw := createSlab(t, SlabClass{Size: 1000, Count: 2}, SlabClass{Size: 100, Count: 2})
+
+	stats := rw.SlabStats()
+	if len(stats) != 2 || stats[0] != (SlabStats{Size: 128, Count: 2}) || stats[1] != (SlabStats{Size: 1024, Count: 2}) {
+		t.Fatalf("SlabStats returned %+v", stats)
+	}
+
+	small, err := rw.Alloc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(small.Data) != 100 || cap(small.Data) != 128 {
+		t.Errorf("Alloc returned len %d, cap %d, expected 100, 128", len(small.Data), cap(small.Data))
+	}
+
+	copy(small.Data, "hello")
+
+	p, err := rw.PayloadAt(small.Offset, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p.Data) != "hello" {
+		t.Errorf("PayloadAt returned %q, expected %q", p.Data, "hello")
+	}
+
+	large, err := rw.Alloc(129)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cap(large.Data) != 1024 {
+		t.Errorf("Alloc(129) returned cap %d, expected 1024", cap(large.Data))
+	}
+
+	if stats := rw.SlabStats(); stats[0].Allocated != 1 || stats[1].Allocated != 1 {
+		t.Errorf("SlabStats returned %+v", stats)
+	}
+
+	for _, p := range []Payload{small, large} {
+		if err := rw.Free(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := rw.SlabStats(); stats[0].Allocated != 0 || stats[1].Allocated != 0 {
+		t.Errorf("SlabStats returned %+v after Free", stats)
+	}
+
+	again, err := rw.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Offset != small.Offset {
+		t.Errorf("Alloc returned offset %d, expected the freed slot at %d", again.Offset, small.Offset)
+	}
+}
+
+// TestSlabFull checks that a full class overflows into
+// a larger one, and that ErrSlabFull and
+// ErrPayloadTooLarge are returned.
+func TestSlabFull(t *testing.T) {
+	rw := createSlab(t, SlabClass{Size: 64, Count: 1}, SlabClass{Size: 128, Count: 1})
+
+	if _, err := rw.Alloc(129); err != ErrPayloadTooLarge {
+		t.Errorf("Alloc(129) returned %v, expected %v", err, ErrPayloadTooLarge)
+	}
+
+	if _, err := rw.Alloc(-1); err != ErrInvalidPayload {
+		t.Errorf("Alloc(-1) returned %v, expected %v", err, ErrInvalidPayload)
+	}
+
+	for _, size := range []int{64, 128} {
+		p, err := rw.Alloc(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cap(p.Data) != size {
+			t.Errorf("Alloc returned cap %d, expected %d", cap(p.Data), size)
+		}
+	}
+
+	if _, err := rw.Alloc(1); err != ErrSlabFull {
+		t.Errorf("Alloc returned %v, expected %v", err, ErrSlabFull)
+	}
+}
+
+// TestSlabDoubleFree checks that a payload freed twice
+// is rejected and does not corrupt the free stack.
+func TestSlabDoubleFree(t *testing.T) {
+	rw := createSlab(t, SlabClass{Size: 64, Count: 2})
+
+	p, err := rw.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Free(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Free(p); err != ErrDoubleFree {
+		t.Fatalf("Free returned %v, expected %v", err, ErrDoubleFree)
+	}
+
+	if stats := rw.SlabStats(); stats[0].Allocated != 0 {
+		t.Errorf("SlabStats returned %d allocated, expected 0", stats[0].Allocated)
+	}
+
+	// A corrupt stack would hand out the same slot
+	// twice, or more slots than the class holds.
+	a, err := rw.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := rw.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Offset == b.Offset {
+		t.Errorf("Alloc returned offset %d twice", a.Offset)
+	}
+
+	if _, err := rw.Alloc(1); err != ErrSlabFull {
+		t.Errorf("Alloc returned %v, expected %v", err, ErrSlabFull)
+	}
+}
+
+// TestSlabPayloadAt checks that PayloadAt rejects
+// offsets that are not the start of a slot and lengths
+// that overrun it.
+func TestSlabPayloadAt(t *testing.T) {
+	rw := createSlab(t, SlabClass{Size: 64, Count: 2})
+
+	p, err := rw.Alloc(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		offset, length int
+	}{
+		{-1, 0},
+		{0, 0},
+		{p.Offset + 1, 0},
+		{p.Offset + 2*64, 0},
+		{p.Offset, -1},
+		{p.Offset, 65},
+		{1 << 30, 0},
+	} {
+		if _, err := rw.PayloadAt(tc.offset, tc.length); err != ErrInvalidPayload {
+			t.Errorf("PayloadAt(%d, %d) returned %v, expected %v", tc.offset, tc.length, err, ErrInvalidPayload)
+		}
+	}
+
+	if _, err := rw.PayloadAt(p.Offset, 64); err != nil {
+		t.Errorf("PayloadAt(%d, 64) returned %v", p.Offset, err)
+	}
+
+	if err := rw.Free(Payload{Offset: p.Offset + 1}); err != ErrInvalidPayload {
+		t.Errorf("Free returned %v, expected %v", err, ErrInvalidPayload)
+	}
+}
+
+// TestSlabContention checks that the free stack never
+// hands out a slot that is already allocated while
+// many goroutines allocate and free concurrently.
+func TestSlabContention(t *testing.T) {
+	const (
+		slots      = 4
+		goroutines = 8
+		iterations = 2000
+	)
+
+	rw := createSlab(t, SlabClass{Size: 64, Count: slots})
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			var token [8]byte
+
+			for i := 0; i < iterations; i++ {
+				p, err := rw.Alloc(len(token))
+				if err == ErrSlabFull {
+					runtime.Gosched()
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				// A slot held by two goroutines at once
+				// has its token overwritten.
+				binary.LittleEndian.PutUint64(token[:], uint64(g)<<32|uint64(i))
+				copy(p.Data, token[:])
+				runtime.Gosched()
+
+				if !bytes.Equal(p.Data, token[:]) {
+					t.Errorf("slot at offset %d was allocated twice", p.Offset)
+				}
+
+				if err := rw.Free(p); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	if stats := rw.SlabStats(); stats[0].Allocated != 0 {
+		t.Errorf("SlabStats returned %d allocated, expected 0", stats[0].Allocated)
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < slots; i++ {
+		p, err := rw.Alloc(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[p.Offset] {
+			t.Fatalf("Alloc returned offset %d twice", p.Offset)
+		}
+
+		seen[p.Offset] = true
+	}
+
+	if _, err := rw.Alloc(1); err != ErrSlabFull {
+		t.Errorf("Alloc returned %v, expected %v", err, ErrSlabFull)
+	}
+}
+
+// TestSendPayload checks that a payload sent by
+// descriptor is received, and may be freed, by a peer.
+func TestSendPayload(t *testing.T) {
+	rw := createSlab(t, SlabClass{Size: 4096, Count: 1})
+
+	peer, err := OpenSimplex(rw.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	p, err := peer.Alloc(3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range p.Data {
+		p.Data[i] = byte(i)
+	}
+
+	if err := peer.SendPayload(p); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := rw.GetPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Data, p.Data) {
+		t.Error("GetPayload returned different data")
+	}
+
+	if err := rw.Free(got); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rw.Write([]byte("not a payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rw.GetPayload(); err != ErrInvalidPayload {
+		t.Errorf("GetPayload returned %v, expected %v", err, ErrInvalidPayload)
+	}
+}
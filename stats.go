@@ -0,0 +1,180 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const waitBuckets = len(sharedMem{}.ReadWaitHist)
+
+// WaitHistogramBounds holds the inclusive upper bound
+// of each bucket of a WaitHistogram, but the last
+// which is unbounded.
+var WaitHistogramBounds = [waitBuckets - 1]time.Duration{
+	time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	time.Millisecond,
+	4 * time.Millisecond,
+}
+
+// WaitHistogram is a histogram of the time spent
+// blocked on a semaphore.
+type WaitHistogram struct {
+	// Counts holds the number of waits that fell into
+	// each bucket, see WaitHistogramBounds. It is not
+	// cumulative.
+	Counts [waitBuckets]uint64
+
+	// Sum is the total time spent waiting.
+	Sum time.Duration
+}
+
+// RingStats describes the state of a single ring of
+// blocks.
+//
+// The counters are stored in the shared memory and so
+// include the activity of every attached process. As
+// the fields are loaded individually, they are not a
+// consistent snapshot of a ring that is in use.
+type RingStats struct {
+	BlockCount int
+	BlockSize  int
+
+	// Readable is the number of blocks that have been
+	// sent by a writer but not yet taken by a reader.
+	Readable int
+	// Writable is the number of blocks that are free to
+	// be taken by a writer.
+	Writable int
+	// InFlight is the number of blocks that have been
+	// taken by a reader or writer but not yet sent.
+	InFlight int
+
+	BlocksSent, BytesSent         uint64
+	BlocksReceived, BytesReceived uint64
+
+	// Overwritten is the number of blocks that were
+	// overwritten before they could be read, see
+	// CreateOptions.Overwrite.
+	Overwritten uint64
+
+	// Aborted is the number of blocks that were taken by
+	// a writer but never sent, either because they were
+	// passed to AbortWriteBuffer or because the writer
+	// exited, see (*ReadWriteCloser).Recover.
+	Aborted uint64
+
+	// ReadWaits and WriteWaits are the number of times
+	// a reader or writer had to block on a semaphore.
+	ReadWaits, WriteWaits uint64
+
+	// ReadWaitTime and WriteWaitTime record how long
+	// readers and writers were blocked for.
+	ReadWaitTime, WriteWaitTime WaitHistogram
+}
+
+// Stats holds the statistics for both directions of
+// the shared memory. For simplex shared memory, Read
+// and Write describe the same ring.
+type Stats struct {
+	Duplex bool
+
+	Read, Write RingStats
+}
+
+// Stats returns the current statistics of the shared
+// memory.
+//
+// For resizable shared memory, they describe the rings
+// currently used by this process. Once rw has been
+// closed, Stats returns the zero Stats.
+func (rw *ReadWriteCloser) Stats() Stats {
+	rw.mapping.RLock()
+	defer rw.mapping.RUnlock()
+
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return Stats{}
+	}
+
+	read, write := rw.acquire(&rw.read), rw.acquire(&rw.write)
+	defer read.seg.release()
+	defer write.seg.release()
+
+	return Stats{
+		Duplex: rw.root.duplex,
+
+		Read:  ringStats(read.shared),
+		Write: ringStats(write.shared),
+	}
+}
+
+func ringStats(shared *sharedMem) RingStats {
+	blockCount := uint32(shared.BlockCount)
+
+	readStart := atomic.LoadUint32((*uint32)(&shared.ReadStart))
+	readEnd := atomic.LoadUint32((*uint32)(&shared.ReadEnd))
+	writeStart := atomic.LoadUint32((*uint32)(&shared.WriteStart)) &^ sealedBit
+	writeEnd := atomic.LoadUint32((*uint32)(&shared.WriteEnd))
+
+	// distance returns the number of blocks from
+	// a up to, but not including, b.
+	distance := func(a, b uint32) int {
+		return int((b + blockCount - a) % blockCount)
+	}
+
+	return RingStats{
+		BlockCount: int(blockCount),
+		BlockSize:  int(shared.BlockSize),
+
+		Readable: distance(readStart, writeEnd),
+		// One block is always kept between WriteStart
+		// and ReadEnd.
+		Writable: distance(writeStart, (readEnd+blockCount-1)%blockCount),
+		InFlight: distance(readEnd, readStart) + distance(writeEnd, writeStart),
+
+		BlocksSent:     atomic.LoadUint64((*uint64)(&shared.BlocksSent)),
+		BytesSent:      atomic.LoadUint64((*uint64)(&shared.BytesSent)),
+		BlocksReceived: atomic.LoadUint64((*uint64)(&shared.BlocksReceived)),
+		BytesReceived:  atomic.LoadUint64((*uint64)(&shared.BytesReceived)),
+
+		Overwritten: atomic.LoadUint64((*uint64)(&shared.BlocksOverwritten)),
+		Aborted:     atomic.LoadUint64((*uint64)(&shared.BlocksAborted)),
+
+		ReadWaits:  atomic.LoadUint64((*uint64)(&shared.ReadWaits)),
+		WriteWaits: atomic.LoadUint64((*uint64)(&shared.WriteWaits)),
+
+		ReadWaitTime:  loadWaitHistogram((*uint64)(&shared.ReadWaitNanos), (*[waitBuckets]uint64)(&shared.ReadWaitHist)),
+		WriteWaitTime: loadWaitHistogram((*uint64)(&shared.WriteWaitNanos), (*[waitBuckets]uint64)(&shared.WriteWaitHist)),
+	}
+}
+
+func loadWaitHistogram(nanos *uint64, hist *[waitBuckets]uint64) WaitHistogram {
+	h := WaitHistogram{
+		Sum: time.Duration(atomic.LoadUint64(nanos)),
+	}
+
+	for i := range h.Counts {
+		h.Counts[i] = atomic.LoadUint64(&hist[i])
+	}
+
+	return h
+}
+
+func recordWait(nanos *uint64, hist *[waitBuckets]uint64, d time.Duration) {
+	atomic.AddUint64(nanos, uint64(d))
+
+	i := 0
+	for i < len(WaitHistogramBounds) && d > WaitHistogramBounds[i] {
+		i++
+	}
+
+	atomic.AddUint64(&hist[i], 1)
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import "time"
+
+// TraceEvent describes a step in the lifecycle of a
+// Buffer.
+type TraceEvent struct {
+	// Block is the index of the block within its ring.
+	Block int
+	// Size is the length of the block's data. It is zero
+	// when a write buffer is acquired.
+	Size int
+
+	// Start is when the call began and Duration is how
+	// long it took, including any time spent blocked on
+	// a semaphore.
+	Start    time.Time
+	Duration time.Duration
+
+	// Held is how long the Buffer was held between being
+	// acquired and being sent. It is only set for
+	// WritePublished and ReadReleased.
+	Held time.Duration
+}
+
+// WaitEvent describes a reader or writer blocking on a
+// semaphore.
+type WaitEvent struct {
+	// Write is true if a writer is waiting for a free
+	// block and false if a reader is waiting for a block
+	// to be sent.
+	Write bool
+
+	// Block is the index of the block being waited on.
+	Block int
+
+	// Start is when the wait began and Duration is how
+	// long it lasted. Duration is zero for WaitStarted.
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Tracer receives callbacks around the lifecycle of
+// each Buffer.
+//
+// The methods are called synchronously from the
+// goroutine using the ReadWriteCloser and may be
+// called concurrently. They should return quickly.
+type Tracer interface {
+	// WriteAcquired is called when GetWriteBuffer
+	// returns a Buffer.
+	WriteAcquired(TraceEvent)
+	// WritePublished is called when SendWriteBuffer
+	// has marked a Buffer as written. Readers see it
+	// once every earlier block has also been sent.
+	WritePublished(TraceEvent)
+
+	// ReadAcquired is called when GetReadBuffer returns
+	// a Buffer.
+	ReadAcquired(TraceEvent)
+	// ReadReleased is called when SendReadBuffer has
+	// marked a Buffer as read. Writers may reuse it once
+	// every earlier block has also been released.
+	ReadReleased(TraceEvent)
+
+	// WaitStarted and WaitFinished are called either
+	// side of blocking on a semaphore.
+	WaitStarted(WaitEvent)
+	WaitFinished(WaitEvent)
+}
+
+// NopTracer is a Tracer that does nothing. It may be
+// embedded to implement only some of the methods of
+// Tracer.
+type NopTracer struct{}
+
+func (NopTracer) WriteAcquired(TraceEvent)  {}
+func (NopTracer) WritePublished(TraceEvent) {}
+func (NopTracer) ReadAcquired(TraceEvent)   {}
+func (NopTracer) ReadReleased(TraceEvent)   {}
+func (NopTracer) WaitStarted(WaitEvent)     {}
+func (NopTracer) WaitFinished(WaitEvent)    {}
+
+// SetTracer sets the Tracer that will receive
+// callbacks from rw. A nil Tracer disables tracing.
+//
+// SetTracer is not safe to call concurrently with
+// other methods of rw.
+func (rw *ReadWriteCloser) SetTracer(t Tracer) {
+	rw.tracer = t
+}
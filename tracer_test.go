@@ -0,0 +1,168 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer records the name and block of each
+// callback it receives.
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+
+	held time.Duration
+}
+
+func (r *recordingTracer) record(name string, block int) {
+	r.mu.Lock()
+	r.events = append(r.events, fmt.Sprintf("%s %d", name, block))
+	r.mu.Unlock()
+}
+
+func (r *recordingTracer) WriteAcquired(e TraceEvent) { r.record("WriteAcquired", e.Block) }
+func (r *recordingTracer) ReadAcquired(e TraceEvent)  { r.record("ReadAcquired", e.Block) }
+
+func (r *recordingTracer) WritePublished(e TraceEvent) {
+	r.record(fmt.Sprintf("WritePublished(%d)", e.Size), e.Block)
+}
+
+func (r *recordingTracer) ReadReleased(e TraceEvent) {
+	r.mu.Lock()
+	r.held = e.Held
+	r.mu.Unlock()
+
+	r.record(fmt.Sprintf("ReadReleased(%d)", e.Size), e.Block)
+}
+
+func (r *recordingTracer) WaitStarted(e WaitEvent) {
+	r.record(fmt.Sprintf("WaitStarted(%t)", e.Write), e.Block)
+}
+
+func (r *recordingTracer) WaitFinished(e WaitEvent) {
+	r.record(fmt.Sprintf("WaitFinished(%t)", e.Write), e.Block)
+}
+
+// TestTracer checks that the Tracer is called for each
+// step in the lifecycle of a Buffer.
+func TestTracer(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	tr := new(recordingTracer)
+	rw.SetTracer(tr)
+
+	buf, err := rw.GetWriteBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Data = buf.Data[:5]
+	if _, err := rw.SendWriteBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err = rw.GetReadBuffer(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if err := rw.SendReadBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"WriteAcquired 0",
+		"WritePublished(5) 0",
+		"ReadAcquired 0",
+		"ReadReleased(5) 0",
+	}
+	if !reflect.DeepEqual(tr.events, expect) {
+		t.Errorf("Tracer received %q, expected %q", tr.events, expect)
+	}
+
+	if tr.held < time.Millisecond {
+		t.Errorf("ReadReleased was held for %v, expected at least 1ms", tr.held)
+	}
+}
+
+// TestTracerWait checks that the Tracer is called
+// either side of blocking on an empty ring.
+func TestTracerWait(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	tr := new(recordingTracer)
+	rw.SetTracer(tr)
+
+	if _, err := rw.GetReadBufferDeadline(time.Now().Add(time.Millisecond)); err == nil {
+		t.Fatal("GetReadBufferDeadline succeeded on an empty ring")
+	}
+
+	expect := []string{
+		"WaitStarted(false) 0",
+		"WaitFinished(false) 0",
+	}
+	if !reflect.DeepEqual(tr.events, expect) {
+		t.Errorf("Tracer received %q, expected %q", tr.events, expect)
+	}
+
+	// A nil Tracer disables tracing.
+	rw.SetTracer(nil)
+
+	if _, err := rw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tr.events) != len(expect) {
+		t.Errorf("Tracer received %q after being removed", tr.events[len(expect):])
+	}
+}
+
+// publishTracer counts the bytes sent, it embeds
+// NopTracer for every other method.
+type publishTracer struct {
+	NopTracer
+	sent int
+}
+
+func (p *publishTracer) WritePublished(e TraceEvent) { p.sent += e.Size }
+
+// TestNopTracer checks that NopTracer may be embedded
+// to implement only some of Tracer.
+func TestNopTracer(t *testing.T) {
+	rw, err := CreateSimplex(testName(t), 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	tr := new(publishTracer)
+	rw.SetTracer(tr)
+
+	if _, err := rw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.sent != 5 {
+		t.Errorf("WritePublished saw %d bytes, expected 5", tr.sent)
+	}
+}
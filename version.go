@@ -0,0 +1,164 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// magic identifies shared memory created by this
+	// package, it is stored in the first four bytes
+	// of the header.
+	magic = 0x6f67736d // "msgo"
+
+	// majorVersion is incremented for any change to the
+	// layout that older peers cannot safely ignore.
+	//
+	// 2: added the magic number and version header.
+	// 3: replaced sem_t with arch-neutral semaphores.
+	// 4: added PublishedAt, Seq and Owner to the block
+	//    header, shrinking the block flags, and so
+	//    Buffer.Flags, from 40 to 24 bytes.
+	majorVersion = 4
+	// minorVersion is incremented for backwards
+	// compatible additions to the end of the header.
+	minorVersion = 0
+
+	// legacyVersion is the single uint32 version that
+	// preceded the magic number. The high bit was set
+	// by 64-bit processes.
+	legacyVersion = 0x00000001
+)
+
+// Features are optional extensions to the layout that
+// peers which do not understand them may safely
+// ignore.
+const (
+	// featureDuplex is set if the shared memory holds a
+	// second ring for the opposite direction.
+	featureDuplex = 1 << iota
+	// featureTimestamps is set if writers must store
+	// the time each block was sent in PublishedAt.
+	featureTimestamps
+)
+
+// Incompatible features are extensions to the layout
+// that peers must understand to use the shared memory.
+const (
+	// incompatResizable is set if the rings may be
+	// sealed and replaced by a later generation, see
+	// (*ReadWriteCloser).Resize.
+	incompatResizable = 1 << iota
+	// incompatAsymmetric is set if the two rings of
+	// duplex shared memory differ in block count or
+	// block size, so the second ring does not mirror
+	// the first.
+	incompatAsymmetric
+	// incompatBroadcast is set if the ring is read by
+	// independent subscribers, see CreateBroadcast. The
+	// subscriber table lies between the header and the
+	// blocks.
+	incompatBroadcast
+	// incompatOverwrite is set if writers overwrite the
+	// oldest unread block rather than wait for a reader,
+	// see CreateOptions.Overwrite. Readers rely on the
+	// sequence number in each block header to count the
+	// blocks they lost.
+	incompatOverwrite
+	// incompatMailbox is set if the single block of the
+	// ring holds a snapshot guarded by a seqlock, see
+	// CreateMailbox.
+	incompatMailbox
+	// incompatSlab is set if a slab region lies between
+	// the rings and the metadata, see CreateOptions.Slab.
+	incompatSlab
+
+	supportedIncompatFeatures = incompatResizable | incompatAsymmetric | incompatBroadcast |
+		incompatOverwrite | incompatMailbox | incompatSlab
+)
+
+// Version is the version of the shared memory layout.
+type Version struct {
+	Major, Minor uint16
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// VersionError is returned by Open* when the shared
+// memory was created with a layout that is not
+// understood by this package.
+type VersionError struct {
+	Wanted, Found Version
+
+	// Features holds the incompatible features in use
+	// by the shared memory that are not supported by
+	// this package.
+	Features uint32
+}
+
+func (e *VersionError) Error() string {
+	if e.Wanted.Major != e.Found.Major {
+		return fmt.Sprintf("shm: unsupported layout version %s, wanted %s", e.Found, e.Wanted)
+	}
+
+	return fmt.Sprintf("shm: unsupported layout features %#x in version %s", e.Features, e.Found)
+}
+
+// initHeader writes everything but the magic number
+// to the header. The magic number must be stored last
+// with atomic.StoreUint32 to publish the header.
+func initHeader(shared *sharedMem, features, incompat uint32) {
+	*(*uint16)(&shared.MajorVersion), *(*uint16)(&shared.MinorVersion) = majorVersion, minorVersion
+	*(*uint32)(&shared.Features) = features
+	*(*uint32)(&shared.IncompatFeatures) = incompat
+	*(*uint32)(&shared.CreatorPID) = uint32(os.Getpid())
+}
+
+// checkHeader validates the magic number, version and
+// features of a header.
+func checkHeader(shared *sharedMem) error {
+	wanted := Version{majorVersion, minorVersion}
+
+	switch atomic.LoadUint32((*uint32)(&shared.Magic)) {
+	case magic:
+	case legacyVersion, legacyVersion | 0x80000000:
+		return &VersionError{
+			Wanted: wanted,
+			Found:  Version{1, 0},
+		}
+	default:
+		return ErrInvalidSharedMemory
+	}
+
+	found := Version{uint16(shared.MajorVersion), uint16(shared.MinorVersion)}
+	if found.Major != majorVersion || found.Minor < minorVersion {
+		return &VersionError{
+			Wanted: wanted,
+			Found:  found,
+		}
+	}
+
+	incompat := uint32(shared.IncompatFeatures)
+	if bad := incompat &^ supportedIncompatFeatures; bad != 0 {
+		return &VersionError{
+			Wanted: wanted,
+			Found:  found,
+
+			Features: bad,
+		}
+	}
+
+	if uint32(shared.HeaderSize) < sharedHeaderSize {
+		return ErrInvalidSharedMemory
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// TestVersionError checks that Open* rejects shared
+// memory with a layout it does not understand, and
+// reports why.
+func TestVersionError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(shared *sharedMem)
+		expect VersionError
+	}{
+		{
+			"legacy",
+			func(shared *sharedMem) {
+				atomic.StoreUint32((*uint32)(&shared.Magic), legacyVersion|0x80000000)
+			},
+			VersionError{Found: Version{1, 0}},
+		},
+		{
+			"newer major",
+			func(shared *sharedMem) {
+				*(*uint16)(&shared.MajorVersion) = majorVersion + 1
+			},
+			VersionError{Found: Version{majorVersion + 1, minorVersion}},
+		},
+		{
+			"older major",
+			func(shared *sharedMem) {
+				*(*uint16)(&shared.MajorVersion) = majorVersion - 1
+			},
+			VersionError{Found: Version{majorVersion - 1, minorVersion}},
+		},
+		{
+			"unknown incompatible feature",
+			func(shared *sharedMem) {
+				*(*uint32)(&shared.IncompatFeatures) |= 1 << 31
+			},
+			VersionError{Found: Version{majorVersion, minorVersion}, Features: 1 << 31},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := testName(t)
+
+			rw, err := CreateSimplex(name, 0600, 4, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Close()
+			defer rw.Unlink()
+
+			tc.modify(rw.root.rings[0].shared)
+
+			peer, err := OpenSimplex(name)
+			if err == nil {
+				peer.Close()
+				t.Fatal("OpenSimplex succeeded")
+			}
+
+			var verr *VersionError
+			if !errors.As(err, &verr) {
+				t.Fatalf("OpenSimplex returned %v, expected a *VersionError", err)
+			}
+
+			tc.expect.Wanted = Version{majorVersion, minorVersion}
+			if *verr != tc.expect {
+				t.Errorf("OpenSimplex returned %+v, expected %+v", *verr, tc.expect)
+			}
+
+			if verr.Error() == "" {
+				t.Error("Error returned an empty string")
+			}
+		})
+	}
+}
+
+// TestNewerMinorVersion checks that shared memory with a
+// later minor version, and features that may be ignored,
+// can still be opened.
+func TestNewerMinorVersion(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	shared := rw.root.rings[0].shared
+	*(*uint16)(&shared.MinorVersion) = minorVersion + 1
+	*(*uint32)(&shared.Features) |= 1 << 31
+
+	peer, err := OpenSimplex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestInvalidMagic checks that shared memory not created
+// by this package is rejected.
+func TestInvalidMagic(t *testing.T) {
+	name := testName(t)
+
+	rw, err := CreateSimplex(name, 0600, 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	defer rw.Unlink()
+
+	atomic.StoreUint32((*uint32)(&rw.root.rings[0].shared.Magic), 0)
+
+	if peer, err := OpenSimplex(name); err != ErrInvalidSharedMemory {
+		if err == nil {
+			peer.Close()
+		}
+
+		t.Fatalf("OpenSimplex returned %v, expected %v", err, ErrInvalidSharedMemory)
+	}
+}